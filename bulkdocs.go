@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+type bulkDoc struct {
+	body []byte
+	err  error
+}
+
+// readBulkDocs reads either a JSON array of documents or one document
+// per line. Bad lines are reported with the document they'd have been.
+func readBulkDocs(r io.Reader) ([]bulkDoc, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c[0] == '[' {
+			break
+		}
+		if c[0] != ' ' && c[0] != '\t' && c[0] != '\r' && c[0] != '\n' {
+			return readDocLines(br)
+		}
+		br.ReadByte()
+	}
+
+	raws := []json.RawMessage{}
+	if err := json.NewDecoder(br).Decode(&raws); err != nil {
+		return nil, err
+	}
+	rv := make([]bulkDoc, len(raws))
+	for i, raw := range raws {
+		rv[i].body = []byte(raw)
+	}
+	return rv, nil
+}
+
+func readDocLines(br *bufio.Reader) ([]bulkDoc, error) {
+	rv := []bulkDoc{}
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			d := bulkDoc{body: line}
+			if !json.Valid(line) {
+				d.err = fmt.Errorf("invalid JSON")
+			}
+			rv = append(rv, d)
+		}
+		if err == io.EOF {
+			return rv, nil
+		}
+	}
+}
+
+type bulkResult struct {
+	ID     string `json:"id,omitempty"`
+	OK     bool   `json:"ok,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func bulkFailure(id string, err error) bulkResult {
+	e := "write_error"
+	switch err {
+	case errQueueFull:
+		e = "queue_full"
+	case errDuplicateKey:
+		e = "conflict"
+	}
+	return bulkResult{ID: id, Error: e, Reason: err.Error()}
+}
+
+// postBulkDocs stores a batch of documents, keyed by their timestamps
+// if the request or database says where to find them, when each must
+// have one, or else by arrival, reporting on each in order. If the write queue was too full
+// to take any of them, it's a 503 the client should retry.
+func postBulkDocs(parts []string, w http.ResponseWriter, req *http.Request) {
+	dbname := parts[0]
+	if _, err := os.Stat(dbPath(dbname)); err != nil {
+		emitError(404, w, "not_found", "no such database")
+		return
+	}
+	docs, err := readBulkDocs(req.Body)
+	if err != nil {
+		emitError(400, w, "bad_request", err.Error())
+		return
+	}
+	writer, _, err := getOrCreateDB(dbname)
+	if err != nil {
+		emitError(500, w, "write_error", err.Error())
+		return
+	}
+
+	cfg := writer.settings()
+	ptr := timestampPtr(req, cfg)
+	// under sequence, where a document ends up is only known once it's
+	// written
+	sync := syncWrite(req) || cfg.syncStores() || cfg.collisions() == "sequence"
+	results := make([]bulkResult, len(docs))
+	waits := make([]chan error, len(docs))
+	keys := make([]string, len(docs))
+	full := 0
+	for i, d := range docs {
+		if d.err != nil {
+			results[i] = bulkResult{Error: "bad_request", Reason: d.err.Error()}
+			continue
+		}
+		k := time.Now().UTC().Format(time.RFC3339Nano)
+		if ptr != "" {
+			k, err = requiredTimestamp(d.body, ptr)
+			if err != nil {
+				results[i] = bulkResult{Error: "bad_request", Reason: err.Error()}
+				continue
+			}
+		}
+		keys[i] = k
+		qi := dbqitem{dbname: dbname, k: k, data: d.body, op: opStoreItem}
+		if sync {
+			qi.cherr, qi.key = make(chan error, 1), &keys[i]
+		}
+		if err := writer.enqueue(qi); err != nil {
+			if err == errQueueFull {
+				full++
+			}
+			results[i] = bulkFailure(k, err)
+			continue
+		}
+		waits[i] = qi.cherr
+		results[i] = bulkResult{ID: k, OK: true}
+	}
+	if full > 0 && full == len(docs) {
+		emitWriteError(w, dbname, errQueueFull)
+		return
+	}
+	for i, ch := range waits {
+		if ch != nil {
+			if err := <-ch; err != nil {
+				results[i] = bulkFailure(results[i].ID, err)
+			} else {
+				results[i].ID = keys[i]
+			}
+		}
+	}
+	mustEncode(201, w, results)
+}
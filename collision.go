@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mschoch/gouchstore"
+)
+
+// What to do when a write's key is already taken.
+var collisionPolicies = map[string]bool{
+	"overwrite": true,
+	"reject":    true,
+	"sequence":  true,
+	"merge":     true,
+}
+
+var errDuplicateKey = errors.New("duplicate key")
+
+// Sequenced keys add a fixed width number to the timestamp they share,
+// so they sort after it and before any later timestamp.
+const seqSep = "#"
+
+func sequenceKey(k string, n int) string {
+	return fmt.Sprintf("%s%s%06d", k, seqSep, n)
+}
+
+// baseKey strips any sequence number from a key.
+func baseKey(k string) string {
+	if i := strings.Index(k, seqSep); i >= 0 {
+		return k[:i]
+	}
+	return k
+}
+
+// keyRangeEnd extends an inclusive end key over the sequenced keys
+// sharing its timestamp.
+func keyRangeEnd(to string) string {
+	if to == "" {
+		return ""
+	}
+	return to + seqSep + "~"
+}
+
+// syncStores says whether stores must wait to be written. Under reject
+// a write is only refused, and under merge only found not to merge,
+// once the writer gets to it, so a write that didn't wait would never
+// hear that it failed.
+func (c dbConfig) syncStores() bool {
+	switch c.collisions() {
+	case "reject", "merge":
+		return true
+	}
+	return false
+}
+
+// existing finds the body stored at k, looking first at what's been
+// written since the last commit, where deletes are nil.
+func existing(db *gouchstore.Gouchstore, batch map[string][]byte, k string) ([]byte, bool) {
+	if body, ok := batch[k]; ok {
+		return body, body != nil
+	}
+	di, err := db.DocumentInfoById(k)
+	if err != nil || di.Deleted {
+		return nil, false
+	}
+	doc, err := db.DocumentByDocumentInfo(di)
+	if err != nil {
+		return nil, false
+	}
+	return doc.Body, true
+}
+
+// resolveCollision works out the key and body to store under policy,
+// and whether the key was taken.
+func resolveCollision(db *gouchstore.Gouchstore, policy string, batch map[string][]byte,
+	k string, data []byte) (string, []byte, bool, error) {
+	old, taken := existing(db, batch, k)
+	if !taken {
+		return k, data, false, nil
+	}
+	switch policy {
+	case "reject":
+		return "", nil, true, errDuplicateKey
+	case "sequence":
+		n := 1
+		for _, ok := existing(db, batch, sequenceKey(k, n)); ok; _, ok = existing(db, batch, sequenceKey(k, n)) {
+			n++
+		}
+		return sequenceKey(k, n), data, true, nil
+	case "merge":
+		merged, err := mergeDocs(old, data)
+		return k, merged, true, err
+	}
+	return k, data, true, nil
+}
+
+// sequenced reports whether a write of data to k is already stored at
+// k or one of its sequence keys, as a replayed write under sequence
+// may have been before a crash.
+func sequenced(db *gouchstore.Gouchstore, batch map[string][]byte, k string, data []byte) bool {
+	for n := 0; ; n++ {
+		sk := k
+		if n > 0 {
+			sk = sequenceKey(k, n)
+		}
+		old, ok := existing(db, batch, sk)
+		if !ok {
+			return false
+		}
+		if bytes.Equal(old, data) {
+			return true
+		}
+	}
+}
+
+// mergeDocs overlays the fields of one JSON object on another.
+func mergeDocs(old, data []byte) ([]byte, error) {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(old, &m); err != nil {
+		return nil, fmt.Errorf("can't merge into a non-object: %v", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("can't merge a non-object: %v", err)
+	}
+	return json.Marshal(m)
+}
@@ -29,16 +29,46 @@ type dbqitem struct {
 	data   []byte
 	op     dbOperation
 	cherr  chan error
+	// where a sync store learns the key it was stored at, if it cares
+	key *string
+	// the log segment holding this item, if it was logged
+	wal uint64
 }
 
 type dbWriter struct {
 	dbname string
 	ch     chan dbqitem
+	// a slot is held for every write in ch
+	slots  chan struct{}
 	quit   chan bool
+	conf   chan dbConfig
+	cfgMu  sync.Mutex
+	config dbConfig
+	wal    *writeAheadLog
 	db     *gouchstore.Gouchstore
+	stats  *dbStat
+
+	// writes spilled from a full queue, which the writer is kicked to
+	// pick up, and how far it's got
+	kick         chan struct{}
+	spillMu      sync.Mutex
+	spilling     bool
+	spillClosed  bool
+	spillFile    *os.File
+	spillSize    int64
+	spillRead    int64
+	spillWaiting []spillWaiter
 }
 
 var errClosed = errors.New("closed")
+var errNotFound = errors.New("not found")
+var errQueueFull = errors.New("write queue full")
+
+func (w *dbWriter) settings() dbConfig {
+	w.cfgMu.Lock()
+	defer w.cfgMu.Unlock()
+	return w.config
+}
 
 func (w *dbWriter) Close() error {
 	select {
@@ -118,10 +148,20 @@ func dbCloseAll() {
 	}
 }
 
+// dbDeletes counts deleted databases, so sessions holding one know
+// when to check it's still there.
+var dbDeletes uint64
+
 func dbdelete(name string) error {
 	dbRemoveConn(name)
+	forgetCachedDB(name)
+	os.Remove(dbConfigPath(name))
+	os.Remove(rollupMarksPath(name))
+	removeWAL(name)
 	// fixme? should wait and then remove DB
-	return os.Remove(dbPath(name))
+	err := os.Remove(dbPath(name))
+	atomic.AddUint64(&dbDeletes, 1)
+	return err
 }
 
 func dblist(root string) []string {
@@ -139,16 +179,12 @@ func dblist(root string) []string {
 	return rv
 }
 
-func dbCompact(dq *dbWriter, bulk gouchstore.BulkWriter, queued int, qi dbqitem) (gouchstore.BulkWriter, error) {
-	start := time.Now()
-	if queued > 0 {
-		bulk.Commit()
-		log.Printf("flushed %d items in %v for per-compact", queued, time.Since(start))
-		bulk.Close()
-	}
+// dbCompact compacts the database once what was queued has been
+// flushed, returning a new bulk writer.
+func dbCompact(dq *dbWriter, bulk gouchstore.BulkWriter, qi dbqitem) (gouchstore.BulkWriter, error) {
+	bulk.Close()
 	dbn := dbPath(dq.dbname)
-	queued = 0
-	start = time.Now()
+	start := time.Now()
 	err := dq.db.Compact(dbn + ".compact")
 	if err != nil {
 		log.Printf("error compacting : %v", err)
@@ -177,82 +213,233 @@ func dbWriteLoop(dw *dbWriter) {
 
 	queued := 0
 	bulk := dw.db.Bulk()
+	// keys written since the last commit, to spot late writes
+	written := []string{}
+	// sync writers waiting for the next commit
+	waiting := []chan error{}
+	// logged items since the last commit, by log segment
+	logged := map[uint64]int{}
+	// bodies written since the last commit, to spot colliding keys and
+	// keys written twice, whose order a commit would lose
+	batch := map[string][]byte{}
+	committed := func(err error) {
+		noteLateWrites(dw.dbname, written, time.Now())
+		written = written[:0]
+		batch = map[string][]byte{}
+		for _, cherr := range waiting {
+			cherr <- err
+		}
+		waiting = waiting[:0]
+		if err == nil && dw.wal != nil {
+			dw.wal.committed(logged)
+			logged = map[uint64]int{}
+		}
+	}
 
-	t := time.NewTimer(*flushTime)
+	cfg := dw.settings()
+	flushDelay := cfg.flushDelay()
+	maxQueue := cfg.maxOpQueue()
+	collisions := cfg.collisions()
+	t := time.NewTimer(flushDelay)
 	defer t.Stop()
-	liveTracker := time.NewTicker(*liveTime)
+	liveTracker := time.NewTicker(cfg.liveTime())
 	defer liveTracker.Stop()
 	liveOps := 0
 
-	dbst := dbStats.getOrCreate(dw.dbname)
+	dbst := dw.stats
 	defer atomic.StoreUint32(&dbst.qlen, 0)
 	defer atomic.AddUint32(&dbst.closes, 1)
 
+	flush := func(what string) error {
+		start := time.Now()
+		err := bulk.Commit()
+		committed(err)
+		log.Printf("flush of %d %v took %v", queued, what, time.Since(start))
+		atomic.AddUint64(&dbst.written, uint64(queued))
+		queued = 0
+		t.Reset(flushDelay)
+		return err
+	}
+
+	handle := func(qi dbqitem) {
+		liveOps++
+		if qi.wal != 0 {
+			logged[qi.wal]++
+		}
+		switch qi.op {
+		case opStoreItem:
+			k, data := qi.k, qi.data
+			if collisions != "overwrite" {
+				var collided bool
+				var err error
+				k, data, collided, err = resolveCollision(dw.db, collisions, batch, k, data)
+				if collided {
+					atomic.AddUint64(&dbst.collisions, 1)
+				}
+				if err != nil {
+					if qi.cherr != nil {
+						qi.cherr <- err
+					}
+					break
+				}
+			}
+			if _, ok := batch[k]; ok {
+				flush("items")
+			}
+			batch[k] = data
+			bulk.Set(gouchstore.NewDocumentInfo(k), gouchstore.NewDocument(k, data))
+			queued++
+			written = append(written, k)
+			if qi.cherr != nil {
+				if qi.key != nil {
+					*qi.key = k
+				}
+				waiting = append(waiting, qi.cherr)
+			}
+		case opDeleteItem:
+			if _, ok := batch[qi.k]; ok {
+				flush("items")
+			}
+			batch[qi.k] = nil
+			queued++
+			bulk.Delete(gouchstore.NewDocumentInfo(qi.k))
+			written = append(written, qi.k)
+			if qi.cherr != nil {
+				waiting = append(waiting, qi.cherr)
+			}
+		case opCompact:
+			if queued > 0 {
+				if err := flush("items before compaction"); err != nil {
+					qi.cherr <- err
+					break
+				}
+			}
+			var err error
+			bulk, err = dbCompact(dw, bulk, qi)
+			qi.cherr <- err
+		default:
+			log.Panicf("unhandled case : %v", qi.op)
+		}
+		// sync writers get committed as soon as the queue drains
+		if queued >= maxQueue || (len(waiting) > 0 && len(dw.ch) == 0) {
+			flush("items")
+		}
+	}
+	// spilled writes came after everything queued, so they're only
+	// handled once the queue has drained, a queue's worth at a time,
+	// and the spill ends once all of it is committed
+	unspill := func() {
+		if len(dw.ch) > 0 || !dw.isSpilling() {
+			return
+		}
+		done, err := dw.readSpill(maxQueue, handle)
+		if err != nil {
+			log.Printf("error reading spilled writes of %v: %v", dw.dbname, err)
+		}
+		if done && queued > 0 && flush("spilled items") != nil {
+			return
+		}
+		if !done || !dw.endSpill() {
+			select {
+			case dw.kick <- struct{}{}:
+			default:
+			}
+		}
+	}
+
 	for {
 		atomic.StoreUint32(&dbst.qlen, uint32(queued))
 		select {
 		case <-dw.quit:
 			start := time.Now()
-			bulk.Commit()
+			committed(bulk.Commit())
 			bulk.Close()
+			if dw.wal != nil {
+				dw.wal.close()
+			}
 			dbclose(dw.db)
 			dbRemoveConn(dw.dbname)
+			dbFailQueued(dw)
 			log.Printf("closed %v with %v items in %v", dw.dbname, queued, time.Since(start))
 			return
+		case cfg := <-dw.conf:
+			flushDelay = cfg.flushDelay()
+			maxQueue = cfg.maxOpQueue()
+			collisions = cfg.collisions()
+			liveTracker.Reset(cfg.liveTime())
 		case <-liveTracker.C:
 			if queued == 0 && liveOps == 0 {
 				log.Printf("closing idle DB: %v", dw.dbname)
 				close(dw.quit)
 			}
 		case qi := <-dw.ch:
-			liveOps++
-			switch qi.op {
-			case opStoreItem:
-				bulk.Set(gouchstore.NewDocumentInfo(qi.k), gouchstore.NewDocument(qi.k, qi.data))
-				queued++
-			case opDeleteItem:
-				queued++
-				bulk.Delete(gouchstore.NewDocumentInfo(qi.k))
-			case opCompact:
-				var err error
-				bulk, err = dbCompact(dw, bulk, queued, qi)
-				qi.cherr <- err
-				atomic.AddUint64(&dbst.written, uint64(queued))
-				queued = 0
-			default:
-				log.Panicf("unhandled case : %v", qi.op)
+			if qi.op != opCompact {
+				<-dw.slots
 			}
-			if queued >= *maxOpQueue {
-				start := time.Now()
-				bulk.Commit()
-				log.Printf("flush of %d items took %v", queued, time.Since(start))
-			}
-			atomic.AddUint64(&dbst.written, uint64(queued))
-			queued = 0
-			t.Reset(*flushTime)
+			handle(qi)
+			unspill()
+		case <-dw.kick:
+			unspill()
 		case <-t.C:
+			unspill()
 			if queued > 0 {
 				start := time.Now()
-				bulk.Commit()
+				committed(bulk.Commit())
 				log.Printf("flush of %d items from timer took %v", queued, time.Since(start))
 				atomic.AddUint64(&dbst.written, uint64(queued))
 				queued = 0
 			}
-			t.Reset(*flushTime)
+			t.Reset(flushDelay)
+		}
+	}
+}
+
+// dbFailQueued tells anyone waiting on items a closed writer never
+// got to that they weren't written.
+func dbFailQueued(dw *dbWriter) {
+	dw.closeSpill()
+	for {
+		select {
+		case qi := <-dw.ch:
+			if qi.cherr != nil {
+				qi.cherr <- errClosed
+			}
+		default:
+			return
 		}
 	}
 }
 
 func dbWriteFun(dbname string) (*dbWriter, error) {
+	cfg, err := dbReadConfig(dbname)
+	if err != nil {
+		return nil, err
+	}
 	db, err := dbopen(dbname)
 	if err != nil {
 		return nil, err
 	}
+	// whatever a crash left behind is replayed even if -wal is off now
+	gen, err := replayWAL(dbname, db, cfg.collisions())
+	if err != nil {
+		dbclose(db)
+		return nil, err
+	}
+	var wal *writeAheadLog
+	if *useWAL {
+		wal = newWAL(dbname, gen)
+	}
 	writer := &dbWriter{
 		dbname: dbname,
-		ch:     make(chan dbqitem, *maxOpQueue),
+		ch:     make(chan dbqitem, cfg.maxOpQueue()),
+		slots:  make(chan struct{}, cfg.maxOpQueue()),
 		quit:   make(chan bool),
+		conf:   make(chan dbConfig, 1),
+		kick:   make(chan struct{}, 1),
+		config: cfg,
+		wal:    wal,
 		db:     db,
+		stats:  dbStats.getOrCreate(dbname),
 	}
 	dbWg.Add(1)
 	go dbWriteLoop(writer)
@@ -278,13 +465,166 @@ func getOrCreateDB(dbname string) (*dbWriter, bool, error) {
 	return writer, opened, nil
 }
 
+// dbReconfigure hands a new configuration to dbname's writer, if it's
+// open. Its queue keeps the size it was opened with.
+func dbReconfigure(dbname string, cfg dbConfig) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	writer := dbConns[dbname]
+	if writer == nil {
+		return
+	}
+	writer.cfgMu.Lock()
+	writer.config = cfg
+	writer.cfgMu.Unlock()
+	select {
+	case <-writer.conf:
+	default:
+	}
+	writer.conf <- cfg
+}
+
+// reserve takes a slot in the write queue, doing what the queueFull
+// policy says if there's none: blocking, at most for queueTimeout if
+// it's set, failing with errQueueFull, or returning false to spill.
+// Without a write-ahead log there's no spilling, so it blocks.
+func (w *dbWriter) reserve() (bool, error) {
+	select {
+	case w.slots <- struct{}{}:
+		return true, nil
+	default:
+	}
+	atomic.AddUint64(&w.stats.queueFull, 1)
+	cfg := w.settings()
+	switch cfg.queueFull() {
+	case "reject":
+		atomic.AddUint64(&w.stats.rejected, 1)
+		return false, errQueueFull
+	case "spill":
+		if w.wal != nil {
+			return false, nil
+		}
+	}
+	timeout := cfg.queueTimeout()
+	if timeout == 0 {
+		w.slots <- struct{}{}
+		return true, nil
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case w.slots <- struct{}{}:
+		return true, nil
+	case <-t.C:
+		atomic.AddUint64(&w.stats.rejected, 1)
+		return false, errQueueFull
+	}
+}
+
+// enqueue logs a write ahead of queueing it, or spills it if the queue
+// is full or earlier writes have spilled.
+func (w *dbWriter) enqueue(qi dbqitem) error {
+	return w.put(qi, w.reserve)
+}
+
+// enqueueWait is enqueue for the server's own writes, which wait for
+// room in the queue whatever the queueFull policy.
+func (w *dbWriter) enqueueWait(qi dbqitem) error {
+	return w.put(qi, func() (bool, error) {
+		w.slots <- struct{}{}
+		return true, nil
+	})
+}
+
+func (w *dbWriter) put(qi dbqitem, reserve func() (bool, error)) error {
+	if spilled, err := w.spillBehind(qi); spilled {
+		return err
+	}
+	queued, err := reserve()
+	if err != nil {
+		return err
+	}
+	if !queued {
+		return w.spill(qi)
+	}
+	if w.wal != nil {
+		if err := w.wal.append(&qi); err != nil {
+			<-w.slots
+			return err
+		}
+	}
+	w.ch <- qi
+	return nil
+}
+
+// dbstore stores an item, returning once it's queued, or once it's
+// committed if the database's collision policy can fail it.
 func dbstore(dbname string, k string, body []byte) error {
 	writer, _, err := getOrCreateDB(dbname)
 	if err != nil {
 		return err
 	}
-	writer.ch <- dbqitem{dbname, k, body, opStoreItem, nil}
-	return nil
+	qi := dbqitem{dbname: dbname, k: k, data: body, op: opStoreItem}
+	if writer.settings().syncStores() {
+		qi.cherr = make(chan error, 1)
+	}
+	if err := writer.enqueue(qi); err != nil || qi.cherr == nil {
+		return err
+	}
+	return <-qi.cherr
+}
+
+// dbstoresync stores an item, returning once it's committed.
+func dbstoresync(dbname string, k string, body []byte) error {
+	writer, _, err := getOrCreateDB(dbname)
+	if err != nil {
+		return err
+	}
+	cherr := make(chan error, 1)
+	err = writer.enqueue(dbqitem{dbname: dbname, k: k, data: body, op: opStoreItem, cherr: cherr})
+	if err != nil {
+		return err
+	}
+	return <-cherr
+}
+
+func dbdeleteitem(dbname string, k string) error {
+	writer, _, err := getOrCreateDB(dbname)
+	if err != nil {
+		return err
+	}
+	return writer.enqueue(dbqitem{dbname: dbname, k: k, op: opDeleteItem})
+}
+
+// dbwriteall makes the server's own writes to dbname, waiting for room
+// in the queue, and returns once they've all been committed with the
+// errors of any that failed.
+func dbwriteall(dbname string, items []dbqitem) []error {
+	if len(items) == 0 {
+		return nil
+	}
+	writer, _, err := getOrCreateDB(dbname)
+	if err != nil {
+		return []error{err}
+	}
+	errs := []error{}
+	cherr := make(chan error, len(items))
+	queued := 0
+	for _, qi := range items {
+		qi.dbname, qi.cherr = dbname, cherr
+		if err := writer.enqueueWait(qi); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		queued++
+	}
+	for ; queued > 0; queued-- {
+		if err := <-cherr; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
 }
 
 func dbcompact(dbname string) error {
@@ -311,7 +651,14 @@ func dbGetDoc(dbname, id string) ([]byte, error) {
 	}
 	defer dbclose(db)
 
-	doc, err := db.DocumentById(id)
+	di, err := db.DocumentInfoById(id)
+	if err != nil {
+		return nil, err
+	}
+	if di.Deleted {
+		return nil, errNotFound
+	}
+	doc, err := db.DocumentByDocumentInfo(di)
 	if err != nil {
 		return nil, err
 	}
@@ -322,12 +669,20 @@ func dbwalk(dbname, from, to string, f func(k string, v []byte) error) error {
 	db, err := dbopen(dbname)
 	if err != nil {
 		log.Printf("error opening db: %v - %v", dbname, err)
+		return err
 	}
 	defer dbclose(db)
 
-	return db.WalkDocs(from, to, func(d *gouchstore.Gouchstore, di *gouchstore.DocumentInfo, doc *gouchstore.Document) error {
+	return db.AllDocuments(from, to, func(d *gouchstore.Gouchstore, di *gouchstore.DocumentInfo, userContext interface{}) error {
+		if di.Deleted {
+			return nil
+		}
+		doc, err := d.DocumentByDocumentInfo(di)
+		if err != nil {
+			return err
+		}
 		return f(di.ID, doc.Body)
-	})
+	}, nil)
 }
 
 func dbwalkkeys(dbname, from, to string, f func(k string) error) error {
@@ -339,12 +694,15 @@ func dbwalkkeys(dbname, from, to string, f func(k string) error) error {
 	defer dbclose(db)
 
 	return db.AllDocuments(from, to, func(db *gouchstore.Gouchstore, di *gouchstore.DocumentInfo, userContext interface{}) error {
+		if di.Deleted {
+			return nil
+		}
 		return f(di.ID)
 	}, nil)
 }
 
 func parseKeys(s string) int64 {
-	t, err := timelib.ParseCanonicalTime(s)
+	t, err := timelib.ParseCanonicalTime(baseKey(s))
 	if err != nil {
 		return -1
 	}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dbConfigExt = ".config"
+
+// dbConfig holds the settings of a single database. It lives next to
+// the database file. Unset fields fall back to the flags of the same
+// name.
+type dbConfig struct {
+	FlushDelay   string       `json:"flushDelay,omitempty"`
+	LiveTime     string       `json:"liveTime,omitempty"`
+	MaxOpQueue   int          `json:"maxOpQueue,omitempty"`
+	QueueFull    string       `json:"queueFull,omitempty"`
+	QueueTimeout string       `json:"queueTimeout,omitempty"`
+	QueryTimeout string       `json:"queryTimeout,omitempty"`
+	Retention    string       `json:"retention,omitempty"`
+	TimestampPtr string       `json:"timestampPtr,omitempty"`
+	Collisions   string       `json:"collisions,omitempty"`
+	Rollups      []rollupRule `json:"rollups,omitempty"`
+}
+
+func dbConfigPath(name string) string {
+	return filepath.Join(*dbRoot, name) + dbConfigExt
+}
+
+// parseRetention parses a Go duration, also accepting a number of
+// days such as "30d".
+func parseRetention(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid retention: %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid retention: %q", s)
+	}
+	return d, nil
+}
+
+func parsePositiveDuration(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %v: %q", name, s)
+	}
+	return d, nil
+}
+
+func (c dbConfig) validate(name string) error {
+	for _, d := range []struct{ name, val string }{
+		{"flushDelay", c.FlushDelay},
+		{"liveTime", c.LiveTime},
+		{"queryTimeout", c.QueryTimeout},
+		{"queueTimeout", c.QueueTimeout},
+	} {
+		if _, err := parsePositiveDuration(d.name, d.val); err != nil {
+			return err
+		}
+	}
+	if c.MaxOpQueue < 0 {
+		return fmt.Errorf("invalid maxOpQueue: %v", c.MaxOpQueue)
+	}
+	if c.QueueFull != "" && !queueFullPolicies[c.QueueFull] {
+		return fmt.Errorf("invalid queueFull: %q", c.QueueFull)
+	}
+	if c.QueueFull == "spill" && !*useWAL {
+		return fmt.Errorf("queueFull spill requires -wal")
+	}
+	if _, err := parseRetention(c.Retention); err != nil {
+		return err
+	}
+	if c.TimestampPtr != "" && !strings.HasPrefix(c.TimestampPtr, "/") {
+		return fmt.Errorf("invalid timestampPtr: %q", c.TimestampPtr)
+	}
+	if c.Collisions != "" && !collisionPolicies[c.Collisions] {
+		return fmt.Errorf("invalid collisions: %q", c.Collisions)
+	}
+	return validateRollups(name, c.Rollups)
+}
+
+func durationOr(s string, dflt time.Duration) time.Duration {
+	if d, _ := parsePositiveDuration("", s); d > 0 {
+		return d
+	}
+	return dflt
+}
+
+func (c dbConfig) flushDelay() time.Duration {
+	return durationOr(c.FlushDelay, *flushTime)
+}
+
+func (c dbConfig) liveTime() time.Duration {
+	return durationOr(c.LiveTime, *liveTime)
+}
+
+func (c dbConfig) maxOpQueue() int {
+	if c.MaxOpQueue > 0 {
+		return c.MaxOpQueue
+	}
+	return *maxOpQueue
+}
+
+// What to do with writes when a database's write queue is full. Only
+// databases with a write-ahead log can spill.
+var queueFullPolicies = map[string]bool{
+	"block":  true,
+	"reject": true,
+	"spill":  true,
+}
+
+func (c dbConfig) queueFull() string {
+	if c.QueueFull != "" {
+		return c.QueueFull
+	}
+	return *queueFull
+}
+
+func (c dbConfig) queueTimeout() time.Duration {
+	return durationOr(c.QueueTimeout, *queueTimeout)
+}
+
+// collisions is what to do with writes to keys that are taken, which
+// is to overwrite them unless the database says otherwise.
+func (c dbConfig) collisions() string {
+	if c.Collisions != "" {
+		return c.Collisions
+	}
+	return "overwrite"
+}
+
+// queryTimeout can only shorten -queryTimeout, which also bounds how
+// long query handlers may run.
+func (c dbConfig) queryTimeout() time.Duration {
+	d := durationOr(c.QueryTimeout, *queryTimeout)
+	if d > *queryTimeout {
+		d = *queryTimeout
+	}
+	return d
+}
+
+func (c dbConfig) retention() time.Duration {
+	d, _ := parseRetention(c.Retention)
+	return d
+}
+
+// dbReadConfig reads the configuration of a database, which is empty
+// if none has been written.
+func dbReadConfig(name string) (dbConfig, error) {
+	rv := dbConfig{}
+	b, err := ioutil.ReadFile(dbConfigPath(name))
+	if os.IsNotExist(err) {
+		return rv, nil
+	}
+	if err != nil {
+		return rv, err
+	}
+	err = json.Unmarshal(b, &rv)
+	return rv, err
+}
+
+func dbWriteConfig(name string, c dbConfig) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	path := dbConfigPath(name)
+	if err := ioutil.WriteFile(path+".tmp", b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// A badConfig is a change that would leave a configuration invalid.
+type badConfig struct {
+	error
+}
+
+var configLock = sync.Mutex{}
+var configLocks = map[string]*sync.Mutex{}
+
+// updateConfig changes the configuration of a database, applying it
+// to its writer if it's open. Updates of a database are serialized so
+// none undoes another.
+func updateConfig(name string, change func(c *dbConfig) error) error {
+	configLock.Lock()
+	mu := configLocks[name]
+	if mu == nil {
+		mu = &sync.Mutex{}
+		configLocks[name] = mu
+	}
+	configLock.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	cfg, err := dbReadConfig(name)
+	if err != nil {
+		return err
+	}
+	if err := change(&cfg); err != nil {
+		return badConfig{err}
+	}
+	if err := cfg.validate(name); err != nil {
+		return badConfig{err}
+	}
+	if err := dbWriteConfig(name, cfg); err != nil {
+		return err
+	}
+	dbReconfigure(name, cfg)
+	return nil
+}
+
+// emitConfigUpdate reports the outcome of updateConfig.
+func emitConfigUpdate(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case nil:
+		mustEncode(200, w, map[string]interface{}{"ok": true})
+	case badConfig:
+		emitError(400, w, "bad_request", err.Error())
+	default:
+		emitError(500, w, "config_error", err.Error())
+	}
+}
+
+func getConfig(parts []string, w http.ResponseWriter, req *http.Request) {
+	if _, err := os.Stat(dbPath(parts[0])); err != nil {
+		emitError(404, w, "not_found", "no such database")
+		return
+	}
+	cfg, err := dbReadConfig(parts[0])
+	if err != nil {
+		emitError(500, w, "config_error", err.Error())
+		return
+	}
+	mustEncode(200, w, cfg)
+}
+
+// putConfig sets the fields of a database's configuration that are in
+// the request, leaving the others as they were.
+func putConfig(parts []string, w http.ResponseWriter, req *http.Request) {
+	if _, err := os.Stat(dbPath(parts[0])); err != nil {
+		emitError(404, w, "not_found", "no such database")
+		return
+	}
+	emitConfigUpdate(w, updateConfig(parts[0], func(c *dbConfig) error {
+		return json.NewDecoder(req.Body).Decode(c)
+	}))
+}
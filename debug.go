@@ -62,17 +62,27 @@ func debugListOpenDBs(parts []string, w http.ResponseWriter, req *http.Request)
 }
 
 type dbStat struct {
-	written             uint64
-	qlen, opens, closes uint32
+	written                      uint64
+	queueFull, rejected, spilled uint64
+	collisions                   uint64
+	qlen, opens, closes          uint32
 }
 
 func (d *dbStat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.values())
+}
+
+func (d *dbStat) values() map[string]interface{} {
 	m := map[string]interface{}{}
 	m["written"] = atomic.LoadUint64(&d.written)
+	m["queue_full"] = atomic.LoadUint64(&d.queueFull)
+	m["rejected"] = atomic.LoadUint64(&d.rejected)
+	m["spilled"] = atomic.LoadUint64(&d.spilled)
+	m["collisions"] = atomic.LoadUint64(&d.collisions)
 	m["qlen"] = atomic.LoadUint32(&d.qlen)
 	m["opens"] = atomic.LoadUint32(&d.opens)
 	m["closes"] = atomic.LoadUint32(&d.closes)
-	return json.Marshal(m)
+	return m
 }
 
 type databaseStats struct {
@@ -96,6 +106,17 @@ func (q *databaseStats) getOrCreate(name string) *dbStat {
 	return rv
 }
 
+// snapshot is the current counters of every database.
+func (q *databaseStats) snapshot() map[string]map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rv := map[string]map[string]interface{}{}
+	for name, d := range q.m {
+		rv[name] = d.values()
+	}
+	return rv
+}
+
 func (q *databaseStats) String() string {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"series/timelib"
+	"sort"
+)
+
+var fillPolicies = map[string]bool{
+	"":         true,
+	"none":     true,
+	"null":     true,
+	"zero":     true,
+	"previous": true,
+	"linear":   true,
+}
+
+// Guard against filling absurd ranges, e.g. a year of millisecond groups.
+const maxFillGroups = 100000
+
+// fillValues replaces the entries of vals that aren't known according
+// to policy. vals is ordered by the group start times in keys.
+func fillValues(policy string, keys []int64, vals []interface{}, known []bool) {
+	prev := -1
+	for i := range vals {
+		if known[i] {
+			prev = i
+			continue
+		}
+		switch policy {
+		case "null":
+			vals[i] = nil
+		case "zero":
+			vals[i] = 0
+		case "previous":
+			if prev >= 0 {
+				vals[i] = vals[prev]
+			}
+		case "linear":
+			next := -1
+			for j := i + 1; j < len(vals); j++ {
+				if known[j] {
+					next = j
+					break
+				}
+			}
+			if prev < 0 || next < 0 {
+				continue
+			}
+			a, aok := parseFloat(vals[prev])
+			b, bok := parseFloat(vals[next])
+			if aok && bok {
+				vals[i] = a + (b-a)*float64(keys[i]-keys[prev])/float64(keys[next]-keys[prev])
+			}
+		}
+	}
+}
+
+// fillRange lists the start of every group from the group containing
+// from through the group containing to.
+func fillRange(g grouper, from, to int64) ([]int64, error) {
+	var rv []int64
+	for start, next := g.bucket(from); start <= to; start, next = g.bucket(next) {
+		if len(rv) >= maxFillGroups {
+			return nil, fmt.Errorf("too many groups to fill")
+		}
+		rv = append(rv, start)
+	}
+	return rv, nil
+}
+
+func fillBound(s string, dflt int64) (int64, error) {
+	if s == "" {
+		return dflt, nil
+	}
+	t, err := timelib.ParseTime(s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
+
+// fillGroups adds a result for every empty group between from and to
+// (or the first and last groups with data when unbounded).
+func fillGroups(out map[int64]*processOut, g grouper, from, to string,
+	policy string, nptrs int) error {
+	if policy == "" || policy == "none" || (len(out) == 0 && (from == "" || to == "")) {
+		return nil
+	}
+
+	first, last := int64(0), int64(0)
+	for k := range out {
+		if first == 0 || k < first {
+			first = k
+		}
+		if k > last {
+			last = k
+		}
+	}
+	start, err := fillBound(from, first)
+	if err != nil {
+		return err
+	}
+	end, err := fillBound(to, last)
+	if err != nil {
+		return err
+	}
+	keys, err := fillRange(g, start, end)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	// keep groups that fell outside the range, e.g. from a late write
+	for k := range out {
+		if k < keys[0] || k > keys[len(keys)-1] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	grouped := false
+	gvals := map[string]bool{}
+	had := map[int64]map[string]bool{}
+	for k, po := range out {
+		had[k] = map[string]bool{}
+		if po.groups != nil {
+			grouped = true
+			for gval := range po.groups {
+				gvals[gval] = true
+				had[k][gval] = true
+			}
+		}
+	}
+
+	for _, k := range keys {
+		if out[k] == nil {
+			po := &processOut{key: k}
+			if grouped {
+				po.groups = map[string][]interface{}{}
+			} else {
+				po.value = make([]interface{}, nptrs)
+			}
+			out[k] = po
+		}
+	}
+
+	vals := make([]interface{}, len(keys))
+	known := make([]bool, len(keys))
+	fill := func(gval string) {
+		for i := 0; i < nptrs; i++ {
+			for j, k := range keys {
+				vals[j] = nil
+				if grouped {
+					known[j] = had[k][gval]
+					if known[j] {
+						vals[j] = out[k].groups[gval][i]
+					}
+				} else {
+					_, known[j] = had[k]
+					if known[j] {
+						vals[j] = out[k].value[i]
+					}
+				}
+			}
+			fillValues(policy, keys, vals, known)
+			for j, k := range keys {
+				if known[j] {
+					continue
+				}
+				po := out[k]
+				if !grouped {
+					po.value[i] = vals[j]
+					continue
+				}
+				if po.groups[gval] == nil {
+					po.groups[gval] = make([]interface{}, nptrs)
+				}
+				po.groups[gval][i] = vals[j]
+			}
+		}
+	}
+
+	if !grouped {
+		fill("")
+	}
+	for gval := range gvals {
+		fill(gval)
+	}
+	return nil
+}
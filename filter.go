@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A filterExpr is either a single comparison of the value at Ptr
+// against Val, or a group of expressions joined by And or Or.
+type filterExpr struct {
+	Ptr string        `json:"ptr,omitempty"`
+	Op  string        `json:"op,omitempty"`
+	Val interface{}   `json:"val,omitempty"`
+	And []*filterExpr `json:"and,omitempty"`
+	Or  []*filterExpr `json:"or,omitempty"`
+
+	re *regexp.Regexp
+}
+
+var filterOps = map[string]string{
+	"":       "eq",
+	"=":      "eq",
+	"==":     "eq",
+	"eq":     "eq",
+	"!=":     "ne",
+	"ne":     "ne",
+	"<":      "lt",
+	"lt":     "lt",
+	"<=":     "le",
+	"le":     "le",
+	">":      "gt",
+	"gt":     "gt",
+	">=":     "ge",
+	"ge":     "ge",
+	"in":     "in",
+	"exists": "exists",
+	"~":      "match",
+	"match":  "match",
+	"prefix": "prefix",
+}
+
+// compile validates the expression and normalizes its operators.
+func (f *filterExpr) compile() error {
+	if len(f.And) > 0 || len(f.Or) > 0 {
+		if f.Ptr != "" || (len(f.And) > 0 && len(f.Or) > 0) {
+			return fmt.Errorf("a filter is either a comparison, an and or an or")
+		}
+		for _, sub := range append(f.And, f.Or...) {
+			if err := sub.compile(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if f.Ptr == "" {
+		return fmt.Errorf("filter requires a pointer")
+	}
+	op, ok := filterOps[f.Op]
+	if !ok {
+		return fmt.Errorf("unknown filter operator: %v", f.Op)
+	}
+	f.Op = op
+	switch op {
+	case "match":
+		s, ok := f.Val.(string)
+		if !ok {
+			return fmt.Errorf("match filter on %v requires a string", f.Ptr)
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		f.re = re
+	case "in":
+		if _, ok := f.Val.([]interface{}); !ok {
+			return fmt.Errorf("in filter on %v requires a list", f.Ptr)
+		}
+	}
+	return nil
+}
+
+// pointers returns every pointer the expression needs fetched.
+func (f *filterExpr) pointers() []string {
+	if f == nil {
+		return nil
+	}
+	var rv []string
+	if f.Ptr != "" {
+		rv = append(rv, f.Ptr)
+	}
+	for _, sub := range append(f.And, f.Or...) {
+		rv = append(rv, sub.pointers()...)
+	}
+	return rv
+}
+
+// filterString renders a document value the way filters have always
+// compared it: strings as-is, numbers via %v.
+func filterString(val interface{}) (string, bool) {
+	switch x := val.(type) {
+	case string:
+		return x, true
+	case float64, bool:
+		return fmt.Sprintf("%v", x), true
+	}
+	return "", false
+}
+
+// compareVals orders a document value against a filter value,
+// numerically when both are numbers and lexically otherwise.
+func compareVals(val, check interface{}) (int, bool) {
+	a, aok := parseFloat(val)
+	b, bok := parseFloat(check)
+	if _, isstr := val.(string); !isstr && aok && bok {
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	}
+	as, aok := filterString(val)
+	bs, bok := filterString(check)
+	if !aok || !bok {
+		return 0, false
+	}
+	return strings.Compare(as, bs), true
+}
+
+func (f *filterExpr) match(fetched map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	switch {
+	case len(f.And) > 0:
+		for _, sub := range f.And {
+			if !sub.match(fetched) {
+				return false
+			}
+		}
+		return true
+	case len(f.Or) > 0:
+		for _, sub := range f.Or {
+			if sub.match(fetched) {
+				return true
+			}
+		}
+		return false
+	}
+
+	val, found := fetched[f.Ptr]
+	if f.Op == "exists" {
+		return found
+	}
+	if !found {
+		return false
+	}
+	switch f.Op {
+	case "in":
+		for _, c := range f.Val.([]interface{}) {
+			if cmp, ok := compareVals(val, c); ok && cmp == 0 {
+				return true
+			}
+		}
+		return false
+	case "match", "prefix":
+		s, ok := filterString(val)
+		if !ok {
+			return false
+		}
+		if f.Op == "match" {
+			return f.re.MatchString(s)
+		}
+		p, _ := filterString(f.Val)
+		return strings.HasPrefix(s, p)
+	}
+	cmp, ok := compareVals(val, f.Val)
+	if !ok {
+		return false
+	}
+	switch f.Op {
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "lt":
+		return cmp < 0
+	case "le":
+		return cmp <= 0
+	case "gt":
+		return cmp > 0
+	case "ge":
+		return cmp >= 0
+	}
+	return false
+}
+
+func (f *filterExpr) String() string {
+	if f == nil {
+		return ""
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Sprintf("%#v", f)
+	}
+	return string(b)
+}
+
+// buildFilter combines the positional f/fv/fo filters with an
+// optional grouped expression into a single compiled filter.
+func buildFilter(filters, filtervals, filterops []string, expr *filterExpr) (*filterExpr, error) {
+	if len(filters) != len(filtervals) {
+		return nil, fmt.Errorf("each filter requires a value")
+	}
+	if len(filterops) > len(filters) {
+		return nil, fmt.Errorf("more filter operators than filters")
+	}
+	rv := &filterExpr{}
+	for i, p := range filters {
+		f := &filterExpr{Ptr: p, Val: filtervals[i]}
+		if i < len(filterops) {
+			f.Op = filterops[i]
+		}
+		if f.Op == "in" {
+			vals := []interface{}{}
+			for _, v := range strings.Split(filtervals[i], ",") {
+				vals = append(vals, v)
+			}
+			f.Val = vals
+		}
+		rv.And = append(rv.And, f)
+	}
+	if expr != nil {
+		rv.And = append(rv.And, expr)
+	}
+	switch len(rv.And) {
+	case 0:
+		return nil, nil
+	case 1:
+		rv = rv.And[0]
+	}
+	return rv, rv.compile()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A grouper assigns a timestamp (in nanoseconds) to the group starting
+// at start and ending just before next.
+type grouper interface {
+	bucket(ts int64) (start, next int64)
+}
+
+// fixedGroup groups by a fixed number of nanoseconds since the epoch.
+type fixedGroup int64
+
+func (g fixedGroup) bucket(ts int64) (int64, int64) {
+	start := (ts / int64(g)) * int64(g)
+	return start, start + int64(g)
+}
+
+type calendarUnit int
+
+const (
+	unitHour = calendarUnit(iota)
+	unitDay
+	unitWeek
+	unitMonth
+	unitQuarter
+	unitYear
+)
+
+var calendarUnits = map[string]calendarUnit{
+	"hour":    unitHour,
+	"day":     unitDay,
+	"week":    unitWeek,
+	"month":   unitMonth,
+	"quarter": unitQuarter,
+	"year":    unitYear,
+}
+
+// calendarGroup groups by calendar units in a given location, so days
+// start at local midnight and months have their real length.
+type calendarGroup struct {
+	unit      calendarUnit
+	loc       *time.Location
+	weekStart time.Weekday
+}
+
+// Hours are counted in absolute time from the local offset of the
+// timestamp, so the repeated hour of a fall-back is two groups, and an
+// hour cut short by an offset that changes mid-hour ends, or starts,
+// at the change. Longer units start at local midnight.
+func (g calendarGroup) bucket(ts int64) (int64, int64) {
+	t := time.Unix(0, ts).In(g.loc)
+	if g.unit == unitHour {
+		return g.hour(ts, t)
+	}
+	y, m, d := t.Date()
+	start, next := g.at(y, m, d, 0).UnixNano(), g.at(y, m, d, 1).UnixNano()
+	// a local midnight skipped or repeated by a change of offset can
+	// put the timestamp on the other side of its date's boundary
+	if ts < start {
+		start, next = g.at(y, m, d, -1).UnixNano(), start
+	} else if ts >= next {
+		start, next = next, g.at(y, m, d, 2).UnixNano()
+	}
+	return start, next
+}
+
+func (g calendarGroup) hour(ts int64, t time.Time) (int64, int64) {
+	_, off := t.Zone()
+	shift := int64(off) * int64(time.Second)
+	local := ts + shift
+	start := local - local%int64(time.Hour)
+	if local%int64(time.Hour) < 0 {
+		start -= int64(time.Hour)
+	}
+	start -= shift
+	next := start + int64(time.Hour)
+	if _, o := time.Unix(0, start).In(g.loc).Zone(); o != off {
+		start = zoneChange(g.loc, start, ts)
+	}
+	if _, o := time.Unix(0, next-1).In(g.loc).Zone(); o != off {
+		next = zoneChange(g.loc, ts, next-1)
+	}
+	return start, next
+}
+
+// zoneChange finds the instant in (lo, hi] at which the UTC offset of
+// loc changes from that at lo to that at hi, which it must do once.
+func zoneChange(loc *time.Location, lo, hi int64) int64 {
+	_, off := time.Unix(0, hi).In(loc).Zone()
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if _, o := time.Unix(0, mid).In(loc).Zone(); o == off {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi
+}
+
+// at is the start of the nth unit after the one holding a local date.
+func (g calendarGroup) at(y int, m time.Month, d, n int) time.Time {
+	switch g.unit {
+	case unitWeek:
+		wd := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Weekday()
+		d -= (int(wd) - int(g.weekStart) + 7) % 7
+		return midnight(y, m, d+7*n, g.loc)
+	case unitMonth:
+		return midnight(y, m+time.Month(n), 1, g.loc)
+	case unitQuarter:
+		m -= (m - 1) % 3
+		return midnight(y, m+time.Month(3*n), 1, g.loc)
+	case unitYear:
+		return midnight(y+n, 1, 1, g.loc)
+	}
+	return midnight(y, m, d+n, g.loc)
+}
+
+// midnight is when a local date starts, which is the change of offset
+// if one skips its midnight.
+func midnight(y int, m time.Month, d int, loc *time.Location) time.Time {
+	t := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	if h := t.Hour(); h > 12 {
+		// placed on the day before, in the offset it's leaving
+		lo := t.UnixNano()
+		return time.Unix(0, zoneChange(loc, lo, lo+int64(24-h)*int64(time.Hour))).In(loc)
+	}
+	return t
+}
+
+var weekdays = map[string]time.Weekday{}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		weekdays[name] = d
+		weekdays[name[:3]] = d
+	}
+}
+
+// newGrouper builds a grouper from a group in milliseconds or a
+// calendar unit name, with the timezone and first day of the week the
+// calendar units should use.
+func newGrouper(group, tz, weekStart string) (grouper, error) {
+	if ms, err := strconv.ParseInt(group, 10, 64); err == nil {
+		if ms <= 0 {
+			return nil, fmt.Errorf("group must be positive")
+		}
+		if tz != "" || weekStart != "" {
+			return nil, fmt.Errorf("tz and weekstart require a calendar group")
+		}
+		return fixedGroup(time.Duration(ms) * time.Millisecond), nil
+	}
+	unit, ok := calendarUnits[group]
+	if !ok {
+		return nil, fmt.Errorf("invalid group: %q", group)
+	}
+	g := calendarGroup{unit: unit, loc: time.UTC, weekStart: time.Monday}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tz: %v", err)
+		}
+		g.loc = loc
+	}
+	if weekStart != "" {
+		d, ok := weekdays[strings.ToLower(weekStart)]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekstart: %q", weekStart)
+		}
+		g.weekStart = d
+	}
+	return g, nil
+}
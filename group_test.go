@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustParseTime(t *testing.T, s string) time.Time {
+	rv, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatalf("error parsing %v: %v", s, err)
+	}
+	return rv
+}
+
+func TestCalendarBucketDST(t *testing.T) {
+	tests := []struct {
+		tz, unit, ts, start, next string
+	}{
+		// America/Los_Angeles springs forward at 2021-03-14 02:00
+		{"America/Los_Angeles", "hour", "2021-03-14T01:30:00-08:00",
+			"2021-03-14T01:00:00-08:00", "2021-03-14T03:00:00-07:00"},
+		{"America/Los_Angeles", "hour", "2021-03-14T03:30:00-07:00",
+			"2021-03-14T03:00:00-07:00", "2021-03-14T04:00:00-07:00"},
+		{"America/Los_Angeles", "day", "2021-03-14T12:00:00-07:00",
+			"2021-03-14T00:00:00-08:00", "2021-03-15T00:00:00-07:00"},
+		{"America/Los_Angeles", "week", "2021-03-14T03:30:00-07:00",
+			"2021-03-08T00:00:00-08:00", "2021-03-15T00:00:00-07:00"},
+		{"America/Los_Angeles", "month", "2021-03-14T03:30:00-07:00",
+			"2021-03-01T00:00:00-08:00", "2021-04-01T00:00:00-07:00"},
+		{"America/Los_Angeles", "quarter", "2021-03-14T03:30:00-07:00",
+			"2021-01-01T00:00:00-08:00", "2021-04-01T00:00:00-07:00"},
+		{"America/Los_Angeles", "year", "2021-03-14T03:30:00-07:00",
+			"2021-01-01T00:00:00-08:00", "2022-01-01T00:00:00-08:00"},
+		// and falls back at 2021-11-07 02:00, repeating 01:00
+		{"America/Los_Angeles", "hour", "2021-11-07T01:30:00-07:00",
+			"2021-11-07T01:00:00-07:00", "2021-11-07T01:00:00-08:00"},
+		{"America/Los_Angeles", "hour", "2021-11-07T01:30:00-08:00",
+			"2021-11-07T01:00:00-08:00", "2021-11-07T02:00:00-08:00"},
+		{"America/Los_Angeles", "day", "2021-11-07T12:00:00-08:00",
+			"2021-11-07T00:00:00-07:00", "2021-11-08T00:00:00-08:00"},
+		{"America/Los_Angeles", "week", "2021-11-07T01:30:00-08:00",
+			"2021-11-01T00:00:00-07:00", "2021-11-08T00:00:00-08:00"},
+		{"America/Los_Angeles", "month", "2021-11-07T01:30:00-08:00",
+			"2021-11-01T00:00:00-07:00", "2021-12-01T00:00:00-08:00"},
+		{"America/Los_Angeles", "quarter", "2021-11-07T01:30:00-08:00",
+			"2021-10-01T00:00:00-07:00", "2022-01-01T00:00:00-08:00"},
+		{"America/Los_Angeles", "year", "2021-11-07T01:30:00-08:00",
+			"2021-01-01T00:00:00-08:00", "2022-01-01T00:00:00-08:00"},
+		// America/Sao_Paulo skipped midnight on 2018-11-04
+		{"America/Sao_Paulo", "day", "2018-11-03T23:30:00-03:00",
+			"2018-11-03T00:00:00-03:00", "2018-11-04T01:00:00-02:00"},
+		{"America/Sao_Paulo", "day", "2018-11-04T01:30:00-02:00",
+			"2018-11-04T01:00:00-02:00", "2018-11-05T00:00:00-02:00"},
+		{"America/Sao_Paulo", "week", "2018-11-04T01:30:00-02:00",
+			"2018-10-29T00:00:00-03:00", "2018-11-05T00:00:00-02:00"},
+		// and repeated the hour before it on 2019-02-16
+		{"America/Sao_Paulo", "day", "2019-02-16T23:30:00-03:00",
+			"2019-02-16T00:00:00-02:00", "2019-02-17T00:00:00-03:00"},
+		{"America/Sao_Paulo", "hour", "2019-02-16T23:30:00-02:00",
+			"2019-02-16T23:00:00-02:00", "2019-02-16T23:00:00-03:00"},
+		// Australia/Lord_Howe springs forward half an hour at 02:00
+		{"Australia/Lord_Howe", "hour", "2021-10-03T01:45:00+10:30",
+			"2021-10-03T01:00:00+10:30", "2021-10-03T02:30:00+11:00"},
+		{"Australia/Lord_Howe", "hour", "2021-10-03T02:45:00+11:00",
+			"2021-10-03T02:30:00+11:00", "2021-10-03T03:00:00+11:00"},
+	}
+	for _, test := range tests {
+		g, err := newGrouper(test.unit, test.tz, "monday")
+		if err != nil {
+			t.Fatalf("error making %v grouper in %v: %v", test.unit, test.tz, err)
+		}
+		ts := mustParseTime(t, test.ts).UnixNano()
+		start, next := g.bucket(ts)
+		wantStart := mustParseTime(t, test.start).UnixNano()
+		wantNext := mustParseTime(t, test.next).UnixNano()
+		if start != wantStart || next != wantNext {
+			t.Errorf("%v %v bucket of %v = %v, %v; want %v, %v", test.tz, test.unit, test.ts,
+				time.Unix(0, start), time.Unix(0, next), test.start, test.next)
+		}
+	}
+}
+
+// Walking the groups around each change of offset must cover every
+// timestamp exactly once.
+func TestCalendarBucketsTile(t *testing.T) {
+	spans := []struct{ tz, from string }{
+		{"America/Los_Angeles", "2021-03-12T00:00:00Z"},
+		{"America/Los_Angeles", "2021-11-05T00:00:00Z"},
+		{"America/Sao_Paulo", "2018-11-02T00:00:00Z"},
+		{"America/Sao_Paulo", "2019-02-15T00:00:00Z"},
+		{"Australia/Lord_Howe", "2021-10-01T00:00:00Z"},
+		{"Australia/Lord_Howe", "2021-04-02T00:00:00Z"},
+	}
+	for _, span := range spans {
+		for unit := range calendarUnits {
+			g, err := newGrouper(unit, span.tz, "")
+			if err != nil {
+				t.Fatalf("error making %v grouper in %v: %v", unit, span.tz, err)
+			}
+			from := mustParseTime(t, span.from)
+			prevStart, prevNext := g.bucket(from.UnixNano())
+			for ts := from; ts.Before(from.Add(96 * time.Hour)); ts = ts.Add(5 * time.Minute) {
+				start, next := g.bucket(ts.UnixNano())
+				if start > ts.UnixNano() || ts.UnixNano() >= next {
+					t.Fatalf("%v %v bucket of %v = %v, %v doesn't hold it", span.tz, unit, ts,
+						time.Unix(0, start), time.Unix(0, next))
+				}
+				if start != prevStart && start != prevNext {
+					t.Fatalf("%v %v bucket of %v starts at %v, not at %v", span.tz, unit, ts,
+						time.Unix(0, start), time.Unix(0, prevNext))
+				}
+				prevStart, prevNext = start, next
+			}
+		}
+	}
+}
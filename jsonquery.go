@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"series/timelib"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A jsonQuery is the document accepted by POST /db/_query.
+type jsonQuery struct {
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Group     interface{}  `json:"group"`
+	TZ        string       `json:"tz"`
+	WeekStart string       `json:"weekstart"`
+	GroupBy   string       `json:"groupby"`
+	Fill      string       `json:"fill"`
+	Stream    bool         `json:"stream"`
+	Series    []jsonSeries `json:"series"`
+}
+
+type jsonSeries struct {
+	Name       string          `json:"name"`
+	Ptr        string          `json:"ptr"`
+	Reducer    string          `json:"reducer"`
+	Filter     *filterExpr     `json:"filter,omitempty"`
+	Transforms []jsonTransform `json:"transforms,omitempty"`
+}
+
+type jsonTransform struct {
+	Op  string  `json:"op"`
+	Arg float64 `json:"arg"`
+}
+
+// A transform rewrites a series' values, ordered by group.
+type transform func(vals []interface{}, arg float64) []interface{}
+
+func mapNumbers(vals []interface{}, f func(float64) float64) []interface{} {
+	for i, v := range vals {
+		if x, ok := parseFloat(v); ok {
+			vals[i] = f(x)
+		}
+	}
+	return vals
+}
+
+var transforms = map[string]transform{
+	"scale": func(vals []interface{}, arg float64) []interface{} {
+		return mapNumbers(vals, func(x float64) float64 { return x * arg })
+	},
+	"offset": func(vals []interface{}, arg float64) []interface{} {
+		return mapNumbers(vals, func(x float64) float64 { return x + arg })
+	},
+	"abs": func(vals []interface{}, arg float64) []interface{} {
+		return mapNumbers(vals, math.Abs)
+	},
+	"round": func(vals []interface{}, arg float64) []interface{} {
+		p := math.Pow(10, arg)
+		return mapNumbers(vals, func(x float64) float64 { return math.Floor(x*p+0.5) / p })
+	},
+	"cumulative_sum": func(vals []interface{}, arg float64) []interface{} {
+		sum := float64(0)
+		return mapNumbers(vals, func(x float64) float64 {
+			sum += x
+			return sum
+		})
+	},
+	"difference": func(vals []interface{}, arg float64) []interface{} {
+		prev := math.NaN()
+		return mapNumbers(vals, func(x float64) float64 {
+			d := x - prev
+			prev = x
+			return d
+		})
+	},
+}
+
+// applyTransforms runs each transform in turn, making the results safe
+// to encode.
+func applyTransforms(ts []jsonTransform, vals []interface{}) []interface{} {
+	for _, t := range ts {
+		vals = transforms[t.Op](vals, t.Arg)
+	}
+	for i, v := range vals {
+		vals[i] = jsonSafe(v)
+	}
+	return vals
+}
+
+// jsonSafe replaces values that can't be represented in JSON with null.
+func jsonSafe(v interface{}) interface{} {
+	if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return nil
+	}
+	return v
+}
+
+func canonicalTime(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	t, err := timelib.ParseTime(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q: %v", s, err)
+	}
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
+
+// A seriesRef locates a named series within one of the compiled queries.
+type seriesRef struct {
+	query, index int
+}
+
+func (jq *jsonQuery) grouper() (grouper, error) {
+	var group string
+	switch g := jq.Group.(type) {
+	case float64:
+		group = strconv.FormatInt(int64(g), 10)
+	case string:
+		group = g
+	default:
+		return nil, fmt.Errorf("group must be milliseconds or a calendar unit")
+	}
+	return newGrouper(group, jq.TZ, jq.WeekStart)
+}
+
+// compile turns the document into one queryIn per distinct filter so
+// series sharing a filter share a scan.
+func (jq *jsonQuery) compile(dbname string) ([]*queryIn, map[string]seriesRef, error) {
+	if len(jq.Series) == 0 {
+		return nil, nil, fmt.Errorf("at least one series is required")
+	}
+	grouper, err := jq.grouper()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fillPolicies[jq.Fill] {
+		return nil, nil, fmt.Errorf("unknown fill policy: %v", jq.Fill)
+	}
+	from, err := canonicalTime(jq.From)
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := canonicalTime(jq.To)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	queries := []*queryIn{}
+	byFilter := map[string]int{}
+	refs := map[string]seriesRef{}
+	for i := range jq.Series {
+		s := &jq.Series[i]
+		if s.Name == "" {
+			s.Name = strconv.Itoa(i)
+		}
+		if _, dup := refs[s.Name]; dup {
+			return nil, nil, fmt.Errorf("duplicate series name: %v", s.Name)
+		}
+		if s.Ptr == "" {
+			return nil, nil, fmt.Errorf("series %v requires a pointer", s.Name)
+		}
+		if _, ok := lookupReducer(s.Reducer); !ok {
+			return nil, nil, fmt.Errorf("series %v: unknown reducer: %v", s.Name, s.Reducer)
+		}
+		for _, t := range s.Transforms {
+			if _, ok := transforms[t.Op]; !ok {
+				return nil, nil, fmt.Errorf("series %v: unknown transform: %v", s.Name, t.Op)
+			}
+		}
+		if s.Filter != nil {
+			if err := s.Filter.compile(); err != nil {
+				return nil, nil, fmt.Errorf("series %v: %v", s.Name, err)
+			}
+		}
+
+		fk := s.Filter.String()
+		qi, ok := byFilter[fk]
+		if !ok {
+			qi = len(queries)
+			byFilter[fk] = qi
+			queries = append(queries, &queryIn{
+				dbname:  dbname,
+				from:    from,
+				to:      to,
+				grouper: grouper,
+				groupby: jq.GroupBy,
+				fill:    jq.Fill,
+				start:   now,
+				filter:  s.Filter,
+			})
+		}
+		q := queries[qi]
+		refs[s.Name] = seriesRef{qi, len(q.ptrs)}
+		q.ptrs = append(q.ptrs, s.Ptr)
+		q.reds = append(q.reds, s.Reducer)
+	}
+	return queries, refs, nil
+}
+
+func postQuery(parts []string, w http.ResponseWriter, req *http.Request) {
+	jq := jsonQuery{}
+	if err := json.NewDecoder(req.Body).Decode(&jq); err != nil {
+		emitError(400, w, "bad_request", err.Error())
+		return
+	}
+	queries, refs, err := jq.compile(parts[0])
+	if err != nil {
+		emitError(400, w, "bad_request", err.Error())
+		return
+	}
+	if jq.Stream {
+		streamJSONQuery(&jq, queries, refs, w)
+		return
+	}
+
+	results, err := jq.run(queries, refs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			emitError(404, w, "not_found", "no such database")
+		} else {
+			emitError(500, w, "query_error", err.Error())
+		}
+		return
+	}
+
+	rv := map[string]map[string]interface{}{}
+	for name, byKey := range results {
+		m := map[string]interface{}{}
+		for k, v := range byKey {
+			m[strconv.FormatInt(k/1e6, 10)] = v
+		}
+		rv[name] = m
+	}
+	mustEncode(200, w, rv)
+}
+
+// run executes the compiled queries, returning each series' transformed
+// values by group.
+func (jq *jsonQuery) run(queries []*queryIn, refs map[string]seriesRef) (map[string]map[int64]interface{}, error) {
+	type queryResult struct {
+		out map[int64]*processOut
+		err error
+	}
+	results := make([]chan queryResult, len(queries))
+	for i, q := range queries {
+		results[i] = make(chan queryResult, 1)
+		go func(q *queryIn, ch chan queryResult) {
+			out, err := collectQuery(q)
+			ch <- queryResult{out, err}
+		}(q, results[i])
+	}
+	outs := make([]map[int64]*processOut, len(queries))
+	var err error
+	for i, ch := range results {
+		r := <-ch
+		if r.err != nil && err == nil {
+			err = r.err
+		}
+		outs[i] = r.out
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]map[int64]interface{}{}
+	for _, s := range jq.Series {
+		ref := refs[s.Name]
+		out := outs[ref.query]
+		keys := make([]int64, 0, len(out))
+		for k := range out {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+		m := map[int64]interface{}{}
+		if jq.GroupBy == "" {
+			vals := make([]interface{}, len(keys))
+			for i, k := range keys {
+				vals[i] = out[k].value[ref.index]
+			}
+			vals = applyTransforms(s.Transforms, vals)
+			for i, k := range keys {
+				m[k] = vals[i]
+			}
+		} else {
+			// transform each group's values across the buckets it appears in
+			bygroup := map[string][]int64{}
+			for _, k := range keys {
+				for gval := range out[k].groups {
+					bygroup[gval] = append(bygroup[gval], k)
+				}
+			}
+			for gval, gkeys := range bygroup {
+				vals := make([]interface{}, len(gkeys))
+				for i, k := range gkeys {
+					vals[i] = out[k].groups[gval][ref.index]
+				}
+				vals = applyTransforms(s.Transforms, vals)
+				for i, k := range gkeys {
+					gm, ok := m[k].(map[string]interface{})
+					if !ok {
+						gm = map[string]interface{}{}
+						m[k] = gm
+					}
+					gm[gval] = vals[i]
+				}
+			}
+		}
+		rv[s.Name] = m
+	}
+	return rv, nil
+}
+
+// streamJSONQuery writes each group's results as it completes, keyed
+// by group and then series name. Streaming needs every series to share
+// one scan and can't fill or transform, which need the whole range.
+func streamJSONQuery(jq *jsonQuery, queries []*queryIn, refs map[string]seriesRef,
+	w http.ResponseWriter) {
+	if len(queries) != 1 {
+		emitError(400, w, "bad_request", "streamed series must share a filter")
+		return
+	}
+	if jq.Fill != "" && jq.Fill != "none" {
+		emitError(400, w, "bad_request", "streamed queries can't be filled")
+		return
+	}
+	for _, s := range jq.Series {
+		if len(s.Transforms) > 0 {
+			emitError(400, w, "bad_request", "streamed series can't be transformed")
+			return
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	wrote := false
+	err := streamQuery(queries[0], func(po *processOut) error {
+		m := map[string]interface{}{}
+		for _, s := range jq.Series {
+			idx := refs[s.Name].index
+			if po.groups == nil {
+				m[s.Name] = jsonSafe(po.value[idx])
+				continue
+			}
+			gm := map[string]interface{}{}
+			for gval, vals := range po.groups {
+				gm[gval] = jsonSafe(vals[idx])
+			}
+			m[s.Name] = gm
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		sep := ","
+		if !wrote {
+			w.WriteHeader(200)
+			sep = "{"
+			wrote = true
+		}
+		_, err = fmt.Fprintf(w, "%s\n%q:%s", sep, strconv.FormatInt(po.key/1e6, 10), b)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+
+	switch {
+	case !wrote && err == nil:
+		mustEncode(200, w, map[string]interface{}{})
+	case !wrote && os.IsNotExist(err):
+		emitError(404, w, "not_found", "no such database")
+	case !wrote:
+		emitError(500, w, "query_error", err.Error())
+	case err != nil:
+		// too late for a status code, report it in the body
+		b, _ := json.Marshal(err.Error())
+		fmt.Fprintf(w, ",\n\"error\":%s}\n", b)
+	default:
+		fmt.Fprintf(w, "\n}\n")
+	}
+}
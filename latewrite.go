@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Cached group results are versioned by the late writes that have
+// landed in their time range. A late write bumps the version of the
+// hour it falls in, so every cache key covering that hour changes and
+// stale results are simply never looked up again. Versions live in
+// memory only, so they start over when the process restarts. Only the
+// local cache is versioned: results kept in memcached (-memcache) are
+// keyed without it and may still be served stale after a late write.
+
+const lateSlot = int64(time.Hour)
+
+type lateVersions struct {
+	base  uint64
+	slots map[int64]uint64
+}
+
+var lateLock = sync.Mutex{}
+var lateWrites = map[string]*lateVersions{}
+
+func getLateVersions(dbname string) *lateVersions {
+	lv := lateWrites[dbname]
+	if lv == nil {
+		lv = &lateVersions{slots: map[int64]uint64{}}
+		lateWrites[dbname] = lv
+	}
+	return lv
+}
+
+// noteLateWrites bumps the version of every hour that keys committed
+// at the given time landed in late.
+func noteLateWrites(dbname string, keys []string, committed time.Time) {
+	horizon := committed.Add(-lateWriteAge).UnixNano()
+
+	lateLock.Lock()
+	defer lateLock.Unlock()
+	var lv *lateVersions
+	for _, k := range keys {
+		ts := parseKeys(k)
+		if ts < 0 || ts >= horizon {
+			continue
+		}
+		if lv == nil {
+			lv = getLateVersions(dbname)
+		}
+		lv.slots[ts/lateSlot]++
+	}
+}
+
+// forgetCachedDB retires every cached result of dbname, e.g. when it
+// is deleted and may later be recreated with different contents.
+func forgetCachedDB(dbname string) {
+	lateLock.Lock()
+	lv := getLateVersions(dbname)
+	lv.base++
+	lv.slots = map[int64]uint64{}
+	lateLock.Unlock()
+
+	if localCache != nil {
+		localCache.invalidateDB(dbname)
+	}
+}
+
+// rangeVersion is the cache version of dbname's documents between lo
+// and hi inclusive.
+func rangeVersion(dbname string, lo, hi int64) uint64 {
+	lateLock.Lock()
+	defer lateLock.Unlock()
+	lv := lateWrites[dbname]
+	if lv == nil {
+		return 0
+	}
+	rv := lv.base << 32
+	for slot, v := range lv.slots {
+		if lo/lateSlot <= slot && slot <= hi/lateSlot {
+			rv += v
+		}
+	}
+	return rv
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"series/timelib"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mschoch/gouchstore"
+)
+
+// Writes whose timestamps are older than this when committed are late:
+// they may land in groups that have already been cached.
+const lateWriteAge = time.Minute
+
+// A cacheSpan identifies a group's results in the local cache along
+// with the range of timestamps (inclusive) whose documents produced
+// them.
+type cacheSpan struct {
+	key    string
+	lo, hi int64
+}
+
+type cacheEntry struct {
+	span   *cacheSpan
+	dbname string
+	po     processOut
+	size   int
+}
+
+// resultCache is an in-process LRU of completed group results.
+type resultCache struct {
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int
+	maxSize int
+}
+
+var localCache *resultCache
+
+func newResultCache(maxSize int) *resultCache {
+	return &resultCache{
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		maxSize: maxSize,
+	}
+}
+
+func copyOut(po processOut) *processOut {
+	rv := po
+	if po.value != nil {
+		rv.value = append([]interface{}{}, po.value...)
+	}
+	if po.groups != nil {
+		rv.groups = make(map[string][]interface{}, len(po.groups))
+		for k, v := range po.groups {
+			rv.groups[k] = append([]interface{}{}, v...)
+		}
+	}
+	return &rv
+}
+
+func (c *resultCache) get(span *cacheSpan) *processOut {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[span.key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return copyOut(e.Value.(*cacheEntry).po)
+}
+
+// put caches po unless its documents may still be changing; later
+// writes to the span are late and change its key.
+func (c *resultCache) put(span *cacheSpan, dbname string, started time.Time, po *processOut) {
+	if po.err != nil || span.hi >= started.Add(-lateWriteAge).UnixNano() {
+		return
+	}
+	b, err := json.Marshal(po)
+	if err != nil {
+		return
+	}
+	e := &cacheEntry{span, dbname, *copyOut(*po), len(b) + len(span.key)}
+	if e.size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[span.key]; ok {
+		c.remove(old)
+	}
+	c.entries[span.key] = c.lru.PushFront(e)
+	c.size += e.size
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *resultCache) remove(e *list.Element) {
+	ce := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, ce.span.key)
+	c.size -= ce.size
+}
+
+// invalidateDB drops everything cached for dbname.
+func (c *resultCache) invalidateDB(dbname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cacheEntry).dbname == dbname {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+func queryBound(s string, dflt int64) (int64, bool) {
+	if s == "" {
+		return dflt, true
+	}
+	t, err := timelib.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+	return t.UnixNano(), true
+}
+
+// cacheSpan describes the group starting at start and ending before
+// end, at the given version, for the local cache, or returns nil if it
+// can't be cached.
+func (q *queryIn) cacheSpan(start, end int64, nextInfo *gouchstore.DocumentInfo,
+	filter *filterExpr, version uint64) *cacheSpan {
+	if localCache == nil {
+		return nil
+	}
+	from, fok := queryBound(q.from, math.MinInt64)
+	to, tok := queryBound(q.to, math.MaxInt64)
+	if !fok || !tok {
+		return nil
+	}
+	lo, hi := start, end-1
+	if from > lo {
+		lo = from
+	}
+	if to < hi {
+		hi = to
+	}
+	next := ""
+	if nextInfo != nil {
+		// rates look at the next document, so it's part of the span
+		next = nextInfo.ID
+		if ts := parseKeys(next); ts > hi {
+			hi = ts
+		}
+	}
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%s\x00%s\x00%s\x00%s\x00%s\x00%d",
+		q.dbname, lo, hi, next, strings.Join(q.ptrs, "\x01"),
+		strings.Join(q.reds, "\x01"), filter, q.groupby, version)
+	return &cacheSpan{key, lo, hi}
+}
@@ -37,8 +37,17 @@ var queryTimeout = flag.Duration("queryTimeout", time.Minute, "maximum amount of
 var staticPath = flag.String("static", "static", "path to static data")
 var addr = flag.String("addr", ":3133", "address to bind to")
 var mcaddr = flag.String("memcbind", "", "")
+var mcAuthFile = flag.String("memcAuth", "", "credentials file memcached clients must authenticate against")
+var mcHashPassword = flag.Bool("memcHashPassword", false, "print the -memcAuth hash of a password read from stdin, and exit")
+var mcAutoCreate = flag.Bool("memcAutoCreate", false, "create buckets memcached clients select if they don't exist")
 var useSyslog = flag.Bool("useSyslog", true, "log to syslog")
 var maxOpQueue = flag.Int("maxOpQueue", 1000, "maximum number of queued items before flushing")
+var retentionInterval = flag.Duration("retentionInterval", time.Hour, "how often to expire documents past their retention")
+var rollupInterval = flag.Duration("rollupInterval", time.Minute, "how often to roll up completed groups into downsampled databases")
+var queueFull = flag.String("queueFull", "block", "what to do with writes when a write queue is full: block, reject or spill (with -wal)")
+var queueTimeout = flag.Duration("queueTimeout", 0, "how long a write may block on a full queue, 0 for ever")
+var useWAL = flag.Bool("wal", false, "log writes ahead of queueing them so a crash can't lose them")
+var localCacheSize = flag.Int("localCacheSize", 64<<20, "bytes of query results to cache in process, 0 to disable")
 
 type routeHandler func(parts []string, w http.ResponseWriter, req *http.Request)
 
@@ -67,6 +76,12 @@ func init() {
 		{"HEAD", regexp.MustCompile("^/(" + dbMatch + ")/?$"), checkDB, defaultDeadline},
 		{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_changes$"), dbChanges, defaultDeadline},
 		{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_query$"), query, defaultDeadline},
+		{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_query$"), postQuery, defaultDeadline},
+		{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_config$"), getConfig, defaultDeadline},
+		{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_config$"), putConfig, defaultDeadline},
+		{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_rollups$"), getRollups, defaultDeadline},
+		{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_rollups$"), putRollups, defaultDeadline},
+		{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_bulk_docs$"), postBulkDocs, time.Second * 30},
 		{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/_bulks"), deleteBulk, *queryTimeout},
 		{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_all"), allDocs, *queryTimeout},
 		{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_dump"), dumpDocs, *queryTimeout},
@@ -197,6 +212,20 @@ func main() {
 	queryWorkers := flag.Int("queryWorkers", halfProcs, "number of query tree walkers")
 	docWorkers := flag.Int("docWorkers", halfProcs, "number of document mapreduce workers")
 	flag.Parse()
+	if !queueFullPolicies[*queueFull] {
+		log.Fatalf("invalid -queueFull policy: %v", *queueFull)
+	}
+	if *queueFull == "spill" && !*useWAL {
+		log.Fatalf("-queueFull spill requires -wal")
+	}
+	if *mcHashPassword {
+		h, err := readPasswordHash(os.Stdin)
+		if err != nil {
+			log.Fatalf("error hashing password: %v", err)
+		}
+		fmt.Println(h)
+		return
+	}
 
 	if *useSyslog {
 		sl, err := syslog.New(syslog.LOG_INFO, "series")
@@ -211,17 +240,23 @@ func main() {
 		log.Fatalf("could not create %v: %v", *dbRoot, err)
 	}
 
-	found := false
-	for i := range routingTable {
-		matches := routingTable[i].Path.FindAllStringSubmatch("/x/_query", 1)
-		if len(matches) > 0 {
-			routingTable[i].Deadline = *queryTimeout
-			found = true
-			break
+	// the query handlers are the routes GET and POST /x/_query reach
+	for _, method := range []string{"GET", "POST"} {
+		found := false
+		for i := range routingTable {
+			if routingTable[i].Method != method {
+				continue
+			}
+			matches := routingTable[i].Path.FindAllStringSubmatch("/x/_query", 1)
+			if len(matches) > 0 {
+				routingTable[i].Deadline = *queryTimeout
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Fatalf("error, couldn't find %v query handler", method)
 		}
-	}
-	if !found {
-		log.Fatalf("error, count't find query handler")
 	}
 
 	processorInput = make(chan *processIn, *docBacklog)
@@ -239,16 +274,33 @@ func main() {
 		}
 	}
 
+	if *localCacheSize > 0 {
+		localCache = newResultCache(*localCacheSize)
+	}
+
 	queryInput = make(chan *queryIn, *queryBacklog)
 	for i := 0; i < *queryWorkers; i++ {
 		go queryExecutor()
 	}
+	replayWALs()
+	if *retentionInterval > 0 {
+		go retentionLoop(*retentionInterval)
+	}
+	if *rollupInterval > 0 {
+		go rollupLoop(*rollupInterval)
+	}
 	if *pprofFile != "" {
 		go startProfile()
 	}
 
 	listeners := []net.Listener{}
 	if *mcaddr != "" {
+		if *mcAuthFile != "" {
+			var err error
+			if mcUsers, err = loadMCUsers(*mcAuthFile); err != nil {
+				log.Fatalf("error loading memcached credentials: %v", err)
+			}
+		}
 		listeners = append(listeners, listenMC(*mcaddr))
 	}
 
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gomemcached"
+)
+
+const AUTH_ERROR = gomemcached.Status(0x20)
+
+// An mcUser is an account in the -memcAuth credentials file, which
+// maps user names to accounts. Password is a hash of the password as
+// -memcHashPassword prints it. Buckets maps bucket names, or "*" for
+// any other, to "r", "w" or "rw". Admins may create and delete
+// buckets.
+type mcUser struct {
+	Password string            `json:"password"`
+	Admin    bool              `json:"admin"`
+	Buckets  map[string]string `json:"buckets"`
+}
+
+// mcUsers is nil when memcached clients needn't authenticate.
+var mcUsers map[string]*mcUser
+
+func loadMCUsers(path string) (map[string]*mcUser, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rv := map[string]*mcUser{}
+	if err := json.Unmarshal(b, &rv); err != nil {
+		return nil, err
+	}
+	for name, u := range rv {
+		if _, _, _, err := parsePasswordHash(u.Password); err != nil {
+			return nil, fmt.Errorf("user %v: %v", name, err)
+		}
+		for bucket, perms := range u.Buckets {
+			if strings.Trim(perms, "rw") != "" {
+				return nil, fmt.Errorf("user %v: invalid permissions for %v: %q",
+					name, bucket, perms)
+			}
+		}
+	}
+	return rv, nil
+}
+
+// Passwords are stored as "pbkdf2-sha256$iterations$salt$key", salt
+// and key in unpadded base64, the key derived with PBKDF2 over
+// HMAC-SHA256.
+const (
+	passwordScheme = "pbkdf2-sha256"
+	passwordIter   = 100000
+	passwordSalt   = 16
+)
+
+var errBadPasswordHash = errors.New("password isn't a hash from -memcHashPassword")
+
+// used to check the passwords of unknown users, so they take as long
+var unknownUserHash, _ = hashPassword([]byte{})
+
+// pbkdf2 derives a key as RFC 8018 describes, with HMAC-SHA256.
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	rv := []byte{}
+	for block := uint32(1); len(rv) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		rv = append(rv, t...)
+	}
+	return rv[:keyLen]
+}
+
+func hashPassword(password []byte) (string, error) {
+	salt := make([]byte, passwordSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2(password, salt, passwordIter, sha256.Size)
+	return strings.Join([]string{passwordScheme, strconv.Itoa(passwordIter),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)}, "$"), nil
+}
+
+// readPasswordHash hashes the first line of r.
+func readPasswordHash(r io.Reader) (string, error) {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return hashPassword([]byte(strings.TrimRight(password, "\r\n")))
+}
+
+func parsePasswordHash(h string) (int, []byte, []byte, error) {
+	parts := strings.Split(h, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return 0, nil, nil, errBadPasswordHash
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return 0, nil, nil, errBadPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, errBadPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, errBadPasswordHash
+	}
+	return iter, salt, key, nil
+}
+
+func checkPassword(h string, password []byte) bool {
+	iter, salt, key, err := parsePasswordHash(h)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2(password, salt, iter, len(key)), key) == 1
+}
+
+func (u *mcUser) can(bucket string, perm string) bool {
+	perms, ok := u.Buckets[bucket]
+	if !ok {
+		perms = u.Buckets["*"]
+	}
+	return strings.Contains(perms, perm)
+}
+
+// allowed reports whether the session may perform perm ("r" or "w") on
+// bucket.
+func (sess *mcSession) allowed(bucket, perm string) bool {
+	return mcUsers == nil || (sess.user != nil && sess.user.can(bucket, perm))
+}
+
+func authError() *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{
+		Status: AUTH_ERROR,
+		Body:   []byte("Auth failure"),
+	}
+}
+
+// authorize refuses requests the session's user may not make, or
+// anything but authentication before it has one.
+func (sess *mcSession) authorize(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if mcUsers == nil {
+		return nil
+	}
+	switch req.Opcode {
+	case gomemcached.SASL_LIST_MECHS, gomemcached.SASL_AUTH, gomemcached.SASL_STEP,
+		gomemcached.NOOP:
+		return nil
+	}
+	if sess.user == nil {
+		return authError()
+	}
+	ok := true
+	switch req.Opcode {
+	case CREATE_BUCKET, DELETE_BUCKET:
+		ok = sess.user.Admin
+	case SELECT_BUCKET:
+		ok = sess.allowed(string(req.Key), "r") || sess.allowed(string(req.Key), "w")
+	case gomemcached.SET, gomemcached.SETQ, gomemcached.DELETE, gomemcached.DELETEQ:
+		ok = sess.dbname == "" || sess.allowed(sess.dbname, "w")
+	case gomemcached.GET, gomemcached.GETQ, gomemcached.GETK, gomemcached.GETKQ, RANGE_SCAN:
+		ok = sess.dbname == "" || sess.allowed(sess.dbname, "r")
+	}
+	if !ok {
+		return authError()
+	}
+	return nil
+}
+
+// saslAuth checks PLAIN credentials: an optional authorization
+// identity, the user name and the password, separated by NULs. Failing
+// leaves the session unauthenticated, whoever it was before.
+func (sess *mcSession) saslAuth(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if mcUsers == nil {
+		return &gomemcached.MCResponse{Body: []byte("Authenticated")}
+	}
+	sess.user = nil
+	if string(req.Key) != "PLAIN" {
+		return authError()
+	}
+	parts := bytes.Split(req.Body, []byte{0})
+	if len(parts) != 3 {
+		return authError()
+	}
+	name, password := string(parts[1]), parts[2]
+	u, ok := mcUsers[name]
+	h := unknownUserHash
+	if ok {
+		h = u.Password
+	}
+	if !checkPassword(h, password) || !ok {
+		log.Printf("memcached authentication failed for %q", name)
+		return authError()
+	}
+	sess.user = u
+	return &gomemcached.MCResponse{Body: []byte("Authenticated")}
+}
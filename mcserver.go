@@ -1,12 +1,20 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/dustin/gomemcached"
 	memcached "github.com/dustin/gomemcached/server"
 	"io"
 	"log"
 	"net"
+	"os"
+	"regexp"
 	"series/timelib"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,45 +23,438 @@ const (
 	DELETE_BUCKET = gomemcached.CommandCode(0x86)
 	LIST_BUCKETS  = gomemcached.CommandCode(0x87)
 	SELECT_BUCKET = gomemcached.CommandCode(0x89)
+	RANGE_SCAN    = gomemcached.CommandCode(0x8a)
 )
 
+const NO_BUCKET = gomemcached.Status(0x08)
+
+var errScanDone = errors.New("scan done")
+var errBadSequence = errors.New("bad sequence number")
+
+// a sequence number as sequenceKey writes it
+var validSequence = regexp.MustCompile("^" + seqSep + "[0-9]{6}$")
+
+// Setting this in a SET's item flags makes it wait until the item is
+// committed.
+const FLAG_SYNC = uint32(1)
+
+func syncRequested(req *gomemcached.MCRequest) bool {
+	return len(req.Extras) >= 4 && binary.BigEndian.Uint32(req.Extras)&FLAG_SYNC != 0
+}
+
+// Failed quiet commands are reported at the next NOOP, keeping at most
+// this many.
+const maxQuietErrors = 1000
+
 type mcSession struct {
 	dbname string
+	// dbDeletes as of when dbname was last seen
+	deletes uint64
+	user    *mcUser
+	// failed quiet commands, and how many more weren't kept
+	failed  []*gomemcached.MCResponse
+	dropped int
+}
+
+func isQuiet(op gomemcached.CommandCode) bool {
+	switch op {
+	case gomemcached.SETQ, gomemcached.GETQ, gomemcached.GETKQ, gomemcached.DELETEQ:
+		return true
+	}
+	return false
 }
 
 func (sess *mcSession) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	res := sess.handle(w, req)
+	if res != nil && isQuiet(req.Opcode) && res.Status != gomemcached.SUCCESS {
+		if len(sess.failed) >= maxQuietErrors {
+			sess.dropped++
+			return nil
+		}
+		res.Opcode = req.Opcode
+		res.Opaque = req.Opaque
+		sess.failed = append(sess.failed, res)
+		return nil
+	}
+	return res
+}
+
+// noop sends the responses of quiet commands that failed since the last
+// NOOP ahead of its own, which says how many failures weren't kept.
+func (sess *mcSession) noop(w io.Writer) *gomemcached.MCResponse {
+	for _, res := range sess.failed {
+		if _, err := res.Transmit(w); err != nil {
+			return &gomemcached.MCResponse{Fatal: true}
+		}
+	}
+	sess.failed = nil
+	res := &gomemcached.MCResponse{}
+	if sess.dropped > 0 {
+		res.Body = []byte(fmt.Sprintf("%d more quiet errors dropped", sess.dropped))
+		sess.dropped = 0
+	}
+	return res
+}
+
+// stat sends each counter of the databases the session may see, or of
+// just the one named by the key, as a response keyed "db:counter". An
+// empty response ends them.
+func (sess *mcSession) stat(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	stats := dbStats.snapshot()
+	names := []string{}
+	for name := range stats {
+		if len(req.Key) > 0 && name != string(req.Key) {
+			continue
+		}
+		if sess.allowed(name, "r") || sess.allowed(name, "w") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		counters := []string{}
+		for c := range stats[name] {
+			counters = append(counters, c)
+		}
+		sort.Strings(counters)
+		for _, c := range counters {
+			res := &gomemcached.MCResponse{
+				Opcode: req.Opcode,
+				Opaque: req.Opaque,
+				Key:    []byte(name + ":" + c),
+				Body:   []byte(fmt.Sprint(stats[name][c])),
+			}
+			if _, err := res.Transmit(w); err != nil {
+				return &gomemcached.MCResponse{Fatal: true}
+			}
+		}
+	}
+	return &gomemcached.MCResponse{}
+}
+
+func (sess *mcSession) handle(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if res := sess.authorize(req); res != nil {
+		return res
+	}
 	switch req.Opcode {
+	case gomemcached.SASL_LIST_MECHS:
+		return &gomemcached.MCResponse{Body: []byte("PLAIN")}
+	case gomemcached.SASL_AUTH:
+		return sess.saslAuth(req)
+	case gomemcached.SASL_STEP:
+		return authError()
 	case SELECT_BUCKET:
-		log.Printf("selecting bucket %s", req.Key)
-		sess.dbname = string(req.Key)
+		return sess.selectBucket(string(req.Key))
+	case CREATE_BUCKET:
+		return createBucket(string(req.Key))
+	case DELETE_BUCKET:
+		return deleteBucket(string(req.Key))
+	case LIST_BUCKETS:
+		names := []string{}
+		for _, name := range dblist(*dbRoot) {
+			if sess.allowed(name, "r") || sess.allowed(name, "w") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return &gomemcached.MCResponse{Body: []byte(strings.Join(names, " "))}
 	case gomemcached.SETQ, gomemcached.SET:
-		fk := string(req.Key)
-		var k string
-		if fk == "" {
-			k = time.Now().UTC().Format(time.RFC3339Nano)
-		} else {
-			t, err := timelib.ParseTime(fk)
-			if err != nil {
-				return &gomemcached.MCResponse{
-					Status: gomemcached.EINVAL,
-					Body:   []byte("Invalid key"),
-				}
+		if !sess.hasBucket() {
+			return noBucket()
+		}
+		return sess.set(req)
+	case gomemcached.GET, gomemcached.GETQ, gomemcached.GETK, gomemcached.GETKQ:
+		if !sess.hasBucket() {
+			return noBucket()
+		}
+		return sess.get(req)
+	case gomemcached.DELETE, gomemcached.DELETEQ:
+		if !sess.hasBucket() {
+			return noBucket()
+		}
+		return sess.delete(req)
+	case RANGE_SCAN:
+		if !sess.hasBucket() {
+			return noBucket()
+		}
+		return sess.rangeScan(w, req)
+	case gomemcached.STAT:
+		return sess.stat(w, req)
+	case gomemcached.NOOP:
+		return sess.noop(w)
+	default:
+		return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COMMAND}
+	}
+}
+
+// hasBucket reports whether the session's bucket is still there,
+// forgetting it once it's been deleted, by this session or another.
+func (sess *mcSession) hasBucket() bool {
+	if sess.dbname == "" {
+		return false
+	}
+	if n := atomic.LoadUint64(&dbDeletes); n != sess.deletes {
+		sess.deletes = n
+		if _, err := os.Stat(dbPath(sess.dbname)); err != nil {
+			sess.dbname = ""
+		}
+	}
+	return sess.dbname != ""
+}
+
+func noBucket() *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{
+		Status: NO_BUCKET,
+		Body:   []byte("No bucket selected"),
+	}
+}
+
+// selectBucket points the session at an existing bucket, creating it
+// first if -memcAutoCreate allows and the session's user is an admin.
+func (sess *mcSession) selectBucket(name string) *gomemcached.MCResponse {
+	if !validDBName.MatchString(name) {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("Invalid bucket name"),
+		}
+	}
+	deletes := atomic.LoadUint64(&dbDeletes)
+	if _, err := os.Stat(dbPath(name)); err != nil {
+		if !*mcAutoCreate {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.KEY_ENOENT,
+				Body:   []byte("No such bucket"),
 			}
-			k = t.UTC().Format(time.RFC3339Nano)
 		}
-		err := dbstore(sess.dbname, k, req.Body)
+		// creating a bucket takes an admin, however it's asked for
+		if !sess.allowed(name, "w") || (mcUsers != nil && !sess.user.Admin) {
+			return authError()
+		}
+		if res := createBucket(name); res.Status != gomemcached.SUCCESS &&
+			res.Status != gomemcached.KEY_EEXISTS {
+			return res
+		}
+	}
+	log.Printf("selecting bucket %s", name)
+	sess.dbname = name
+	sess.deletes = deletes
+	return &gomemcached.MCResponse{}
+}
+
+func createBucket(name string) *gomemcached.MCResponse {
+	if !validDBName.MatchString(name) {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("Invalid bucket name"),
+		}
+	}
+	if _, err := os.Stat(dbPath(name)); err == nil {
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_EEXISTS}
+	}
+	if err := dbcreate(dbPath(name)); err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.NOT_STORED,
+			Body:   []byte(err.Error()),
+		}
+	}
+	log.Printf("created bucket %s", name)
+	return &gomemcached.MCResponse{}
+}
+
+func deleteBucket(name string) *gomemcached.MCResponse {
+	if !validDBName.MatchString(name) {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("Invalid bucket name"),
+		}
+	}
+	if _, err := os.Stat(dbPath(name)); err != nil {
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	}
+	if err := dbdelete(name); err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.NOT_STORED,
+			Body:   []byte(err.Error()),
+		}
+	}
+	log.Printf("deleted bucket %s", name)
+	return &gomemcached.MCResponse{}
+}
+
+// mcKey canonicalizes an item's timestamp key, keeping any sequence
+// number.
+func mcKey(fk string) (string, error) {
+	seq := fk[len(baseKey(fk)):]
+	if seq != "" && !validSequence.MatchString(seq) {
+		return "", errBadSequence
+	}
+	t, err := timelib.ParseTime(baseKey(fk))
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(time.RFC3339Nano) + seq, nil
+}
+
+func invalidKey() *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{
+		Status: gomemcached.EINVAL,
+		Body:   []byte("Invalid key"),
+	}
+}
+
+func (sess *mcSession) writeFailed(err error) *gomemcached.MCResponse {
+	if err == errQueueFull {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body: []byte(fmt.Sprintf("%v, retry after %v",
+				err, retryAfter(sess.dbname))),
+		}
+	}
+	if err == errDuplicateKey {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_EEXISTS,
+			Body:   []byte(err.Error()),
+		}
+	}
+	return &gomemcached.MCResponse{
+		Status: gomemcached.NOT_STORED,
+		Body:   []byte(err.Error()),
+	}
+}
+
+func (sess *mcSession) set(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	fk := string(req.Key)
+	var k string
+	if fk == "" {
+		// keyless items are keyed by their own timestamp if the
+		// database says where it is
+		ptr, err := dbTimestampPtr(sess.dbname)
 		if err != nil {
+			return sess.writeFailed(err)
+		}
+		if ptr == "" {
+			k = time.Now().UTC().Format(time.RFC3339Nano)
+		} else if k, err = requiredTimestamp(req.Body, ptr); err != nil {
 			return &gomemcached.MCResponse{
-				Status: gomemcached.NOT_STORED,
+				Status: gomemcached.EINVAL,
 				Body:   []byte(err.Error()),
 			}
 		}
-		if req.Opcode == gomemcached.SETQ {
+	} else {
+		var err error
+		if k, err = mcKey(fk); err != nil {
+			return invalidKey()
+		}
+	}
+	var err error
+	if syncRequested(req) {
+		err = dbstoresync(sess.dbname, k, req.Body)
+	} else {
+		err = dbstore(sess.dbname, k, req.Body)
+	}
+	if err != nil {
+		return sess.writeFailed(err)
+	}
+	if req.Opcode == gomemcached.SETQ {
+		return nil
+	}
+	return &gomemcached.MCResponse{}
+}
+
+// get reads back a committed item. Quiet gets only answer hits.
+func (sess *mcSession) get(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	quiet := req.Opcode == gomemcached.GETQ || req.Opcode == gomemcached.GETKQ
+	k, err := mcKey(string(req.Key))
+	if err != nil {
+		return invalidKey()
+	}
+	body, err := dbGetDoc(sess.dbname, k)
+	if err != nil {
+		if quiet {
 			return nil
 		}
-	case gomemcached.NOOP:
-	default:
-		return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COMMAND}
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_ENOENT,
+			Body:   []byte(err.Error()),
+		}
+	}
+	res := &gomemcached.MCResponse{
+		Extras: make([]byte, 4),
+		Body:   body,
+	}
+	if req.Opcode == gomemcached.GETK || req.Opcode == gomemcached.GETKQ {
+		res.Key = []byte(k)
+	}
+	return res
+}
+
+func (sess *mcSession) delete(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	k, err := mcKey(string(req.Key))
+	if err != nil {
+		return invalidKey()
+	}
+	// like a GET, this only sees what's been committed
+	if _, err := dbGetDoc(sess.dbname, k); err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_ENOENT,
+			Body:   []byte(err.Error()),
+		}
+	}
+	if err := dbdeleteitem(sess.dbname, k); err != nil {
+		return sess.writeFailed(err)
+	}
+	if req.Opcode == gomemcached.DELETEQ {
+		return nil
+	}
+	return &gomemcached.MCResponse{}
+}
+
+// rangeScan streams the committed items from the timestamp in the key
+// through the one in the body, either of which may be empty to leave
+// that end open. Four bytes of extras may limit how many are sent. Each
+// item is a response carrying its key; a response without one ends the
+// scan.
+func (sess *mcSession) rangeScan(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	from, to := string(req.Key), string(req.Body)
+	var err error
+	if from != "" {
+		if from, err = mcKey(from); err != nil {
+			return invalidKey()
+		}
+	}
+	if to != "" {
+		if to, err = mcKey(to); err != nil {
+			return invalidKey()
+		}
+		to = keyRangeEnd(to)
+	}
+	limit := uint32(0)
+	if len(req.Extras) >= 4 {
+		limit = binary.BigEndian.Uint32(req.Extras)
+	}
+
+	sent := uint32(0)
+	err = dbwalk(sess.dbname, from, to, func(k string, v []byte) error {
+		res := &gomemcached.MCResponse{
+			Opcode: req.Opcode,
+			Opaque: req.Opaque,
+			Key:    []byte(k),
+			Body:   v,
+		}
+		if _, err := res.Transmit(w); err != nil {
+			return err
+		}
+		sent++
+		if limit > 0 && sent >= limit {
+			return errScanDone
+		}
+		return nil
+	})
+	if err != nil && err != errScanDone {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(err.Error()),
+		}
 	}
 	return &gomemcached.MCResponse{}
 }
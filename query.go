@@ -7,7 +7,6 @@ import (
 	"github.com/dustin/go-jsonpointer"
 	"log"
 	"math"
-	"reflect"
 	"sync/atomic"
 	"time"
 
@@ -30,9 +29,13 @@ type processOut struct {
 	err         error
 	cacheKey    string
 	cacheOpaque uint32
+	groups      map[string][]interface{}
 }
 
 func (p processOut) MarshalJSON() ([]byte, error) {
+	if p.groups != nil {
+		return json.Marshal(map[string]interface{}{"v": p.groups})
+	}
 	return json.Marshal(map[string]interface{}{"v": p.value})
 }
 
@@ -46,6 +49,9 @@ type processIn struct {
 	reds       []string
 	filters    []string
 	filtervals []string
+	filter     *filterExpr
+	groupby    string
+	span       *cacheSpan
 	before     time.Time
 	out        chan<- *processOut
 }
@@ -55,14 +61,20 @@ type queryIn struct {
 	from       string
 	to         string
 	group      int
+	grouper    grouper
+	groupby    string
+	fill       string
 	start      time.Time
 	before     time.Time
 	ptrs       []string
 	reds       []string
 	filters    []string
 	filtervals []string
+	filterops  []string
+	filter     *filterExpr
 	started    int32
 	totalKeys  int32
+	keys       chan int64
 	out        chan *processOut
 	cherr      chan error
 }
@@ -76,47 +88,46 @@ func resolveFetch(doc []byte, keys []string) map[string]interface{} {
 	for k, v := range found {
 		var val interface{}
 		err = json.Unmarshal(v, &val)
-		if err != nil {
+		if err == nil {
 			ret[k] = val
 		}
 	}
 	return ret
 }
 
-func processDoc(di *gouchstore.DocumentInfo, chs []chan ptrval, doc []byte,
-	ptrs []string, filters []string, filtervals []string, included bool) {
+// fetchFiltered resolves the pointers a document needs, reporting
+// whether it passes the filter.
+func fetchFiltered(doc []byte, ptrs []string, filter *filterExpr,
+	groupby string) (map[string]interface{}, bool) {
 	seen := map[string]bool{}
 	var keys []string
-	for _, p := range ptrs {
-		if !seen[p] {
+	add := func(p string) {
+		if p != "" && !seen[p] {
 			seen[p] = true
 			keys = append(keys, p)
 		}
 	}
-	for _, f := range filters {
-		if !seen[f] {
-			seen[f] = true
-			keys = append(keys, f)
-		}
+	for _, p := range ptrs {
+		add(p)
+	}
+	for _, p := range filter.pointers() {
+		add(p)
 	}
+	add(groupby)
 	fetched := resolveFetch(doc, keys)
-	for i, p := range filters {
-		val := fetched[p]
-		checkval := filtervals[i]
-		switch val.(type) {
-		case string:
-			if val != checkval {
-				return
-			}
-		case int, uint, uint64, int64, float64:
-			v := fmt.Sprintf("%v", val)
-			if v != checkval {
-				return
-			}
-		default:
-			return
-		}
+	return fetched, filter.match(fetched)
+}
+
+func processDoc(di *gouchstore.DocumentInfo, chs []chan ptrval, doc []byte,
+	ptrs []string, filter *filterExpr, included bool) {
+	fetched, ok := fetchFiltered(doc, ptrs, filter, "")
+	if ok {
+		emitDoc(di, chs, ptrs, fetched, included)
 	}
+}
+
+func emitDoc(di *gouchstore.DocumentInfo, chs []chan ptrval, ptrs []string,
+	fetched map[string]interface{}, included bool) {
 	pv := ptrval{
 		di:       di,
 		val:      nil,
@@ -140,11 +151,19 @@ func processDoc(di *gouchstore.DocumentInfo, chs []chan ptrval, doc []byte,
 }
 
 func processDocs(pi *processIn) {
-	result := processOut{pi.key, nil, nil, pi.cacheKey, 0}
+	result := processOut{pi.key, nil, nil, pi.cacheKey, 0, nil}
 
 	if len(pi.ptrs) == 0 {
 		log.Panicf("No pointers specified in query, %#v", pi)
 	}
+	started := time.Now()
+	if pi.span != nil {
+		if po := localCache.get(pi.span); po != nil {
+			po.key = pi.key
+			pi.out <- po
+			return
+		}
+	}
 	db, err := dbopen(pi.dbname)
 	if err != nil {
 		result.err = err
@@ -153,25 +172,10 @@ func processDocs(pi *processIn) {
 	}
 	defer dbclose(db)
 
-	chans := make([]chan ptrval, 0, len(pi.ptrs))
-	resultchans := make([]chan interface{}, 0, len(pi.ptrs))
-	for i, r := range pi.reds {
-		chans[i] = make(chan ptrval)
-		resultchans[i] = make(chan interface{})
-
-		go func(fi int, fr string) {
-			resultchans[fi] <- reducers[fr](chans[fi])
-		}(i, r)
-	}
-
-	go func() {
-		closeAll := func(chans interface{}) {
-			v := reflect.ValueOf(chans)
-			for i, imax := 0, v.Len(); i < imax; i++ {
-				v.Index(i).Close()
-			}
-		}
-		defer closeAll(chans)
+	if pi.groupby != "" {
+		result.groups = processGroupedDocs(pi, db)
+	} else {
+		chans, resultchans := startReducers(pi.reds)
 		doDoc := func(di *gouchstore.DocumentInfo, included bool) {
 			doc, err := db.DocumentByDocumentInfo(di)
 			if err != nil {
@@ -179,7 +183,7 @@ func processDocs(pi *processIn) {
 					chans[i] <- ptrval{di, nil, included}
 				}
 			} else {
-				processDoc(di, chans, doc.Body, pi.ptrs, pi.filters, pi.filtervals, included)
+				processDoc(di, chans, doc.Body, pi.ptrs, pi.filter, included)
 			}
 		}
 
@@ -189,17 +193,12 @@ func processDocs(pi *processIn) {
 		if pi.nextInfo != nil {
 			doDoc(pi.nextInfo, false)
 		}
-	}()
-
-	results := make([]interface{}, len(pi.ptrs))
-	for i := range pi.ptrs {
-		results[i] = <-resultchans[i]
-		if f, fok := results[i].(float64); fok && (math.IsNaN(f) || math.IsInf(f, 0)) {
-			results[i] = 0
-		}
+		result.value = collectReducers(chans, resultchans)
 	}
-	result.value = results
 
+	if pi.span != nil {
+		localCache.put(pi.span, pi.dbname, started, &result)
+	}
 	if result.cacheOpaque == 0 && result.cacheKey != "" {
 		select {
 		case cacheInputSet <- &result:
@@ -209,22 +208,104 @@ func processDocs(pi *processIn) {
 	pi.out <- &result
 }
 
+// startReducers starts one reducer per name, each fed by the channel
+// at the same index.
+func startReducers(reds []string) ([]chan ptrval, []chan interface{}) {
+	chans := make([]chan ptrval, 0, len(reds))
+	resultchans := make([]chan interface{}, 0, len(reds))
+	for i, r := range reds {
+		chans = append(chans, make(chan ptrval))
+		resultchans = append(resultchans, make(chan interface{}))
+
+		red, _ := lookupReducer(r)
+		go func(in chan ptrval, out chan interface{}, fr reducer) {
+			out <- fr(in)
+		}(chans[i], resultchans[i], red)
+	}
+	return chans, resultchans
+}
+
+// collectReducers closes the reducer inputs and gathers their results.
+func collectReducers(chans []chan ptrval, resultchans []chan interface{}) []interface{} {
+	for _, ch := range chans {
+		close(ch)
+	}
+	results := make([]interface{}, len(resultchans))
+	for i := range resultchans {
+		results[i] = <-resultchans[i]
+		if f, fok := results[i].(float64); fok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			results[i] = 0
+		}
+	}
+	return results
+}
+
+// processGroupedDocs reduces the documents separately for each distinct
+// value at the groupby pointer. Documents without a value are skipped.
+func processGroupedDocs(pi *processIn, db *gouchstore.Gouchstore) map[string][]interface{} {
+	type reduction struct {
+		chans       []chan ptrval
+		resultchans []chan interface{}
+	}
+	groups := map[string]*reduction{}
+
+	doDoc := func(di *gouchstore.DocumentInfo, included bool) {
+		doc, err := db.DocumentByDocumentInfo(di)
+		if err != nil {
+			return
+		}
+		fetched, ok := fetchFiltered(doc.Body, pi.ptrs, pi.filter, pi.groupby)
+		if !ok {
+			return
+		}
+		gval, ok := filterString(fetched[pi.groupby])
+		if !ok {
+			return
+		}
+		r := groups[gval]
+		if r == nil {
+			if !included {
+				// only extend groups already present in this bucket
+				return
+			}
+			r = &reduction{}
+			r.chans, r.resultchans = startReducers(pi.reds)
+			groups[gval] = r
+		}
+		emitDoc(di, r.chans, pi.ptrs, fetched, included)
+	}
+
+	for _, di := range pi.infos {
+		doDoc(di, true)
+	}
+	if pi.nextInfo != nil {
+		doDoc(pi.nextInfo, false)
+	}
+
+	rv := make(map[string][]interface{}, len(groups))
+	for gval, r := range groups {
+		rv[gval] = collectReducers(r.chans, r.resultchans)
+	}
+	return rv
+}
+
 func docProcessor(ch <-chan *processIn) {
 	for pi := range ch {
 		if time.Now().Before(pi.before) {
 			processDocs(pi)
 		} else {
-			pi.out <- &processOut{pi.key, nil, errTimeout, "", 0}
+			pi.out <- &processOut{pi.key, nil, errTimeout, "", 0, nil}
 		}
 	}
 }
 
 func fetchDocs(dbname string, key int64, infos []*gouchstore.DocumentInfo,
 	nextInfo *gouchstore.DocumentInfo, ptrs []string, reds []string, filters []string,
-	filtervals []string, before time.Time, out chan<- *processOut) {
+	filtervals []string, filter *filterExpr, groupby string, span *cacheSpan,
+	before time.Time, out chan<- *processOut) {
 
 	i := processIn{infos, nextInfo, key, dbname, "", ptrs, reds, filters,
-		filtervals, before, out}
+		filtervals, filter, groupby, span, before, out}
 	cacheInput <- &i
 }
 
@@ -233,7 +314,23 @@ func runQuery(q *queryIn) {
 		q.cherr <- fmt.Errorf("at least one query is required")
 		return
 	}
-	if q.group == 0 {
+	if len(q.ptrs) != len(q.reds) {
+		q.cherr <- fmt.Errorf("each pointer requires a reducer")
+		return
+	}
+	for _, r := range q.reds {
+		if _, ok := lookupReducer(r); !ok {
+			q.cherr <- fmt.Errorf("unknown reducer: %v", r)
+			return
+		}
+	}
+	filter, err := buildFilter(q.filters, q.filtervals, q.filterops, q.filter)
+	if err != nil {
+		q.cherr <- err
+		return
+	}
+	grouper := q.getGrouper()
+	if grouper == nil {
 		q.cherr <- fmt.Errorf("group level can't be zero")
 		return
 	}
@@ -246,21 +343,208 @@ func runQuery(q *queryIn) {
 	}
 	defer dbclose(db)
 
-	chunk := int64(time.Duration(q.group) * time.Millisecond)
-
 	info := []*gouchstore.DocumentInfo{}
-	g := int64(0)
+	g, gend := int64(0), int64(0)
 	nextg := ""
 
-	err = db.AllDocuments(q.from, q.to, func(db *gouchstore.Gouchstore, di *gouchstore.DocumentInfo,
+	issue := func(nextInfo *gouchstore.DocumentInfo) {
+		atomic.AddInt32(&q.started, 1)
+		if q.keys != nil {
+			q.keys <- g
+		}
+		hi := gend - 1
+		if nextInfo != nil {
+			if ts := parseKeys(nextInfo.ID); ts > hi {
+				hi = ts
+			}
+		}
+		version := rangeVersion(q.dbname, g, hi)
+		fetchDocs(q.dbname, g, info, nextInfo, q.ptrs, q.reds, q.filters,
+			q.filtervals, filter, q.groupby, q.cacheSpan(g, gend, nextInfo, filter, version),
+			q.before, q.out)
+	}
+
+	err = db.AllDocuments(q.from, keyRangeEnd(q.to), func(db *gouchstore.Gouchstore, di *gouchstore.DocumentInfo,
 		userContext interface{}) error {
+		if di.Deleted {
+			return nil
+		}
 		kstr := di.ID
 		var err error
+		if nextg != "" && kstr >= nextg {
+			if len(info) > 0 {
+				issue(di)
+				info = make([]*gouchstore.DocumentInfo, 0, len(info))
+			}
+			g = 0
+		}
 
+		k := parseKeys(kstr)
+		if k < 0 {
+			return nil
+		}
+		if g == 0 {
+			g, gend = grouper.bucket(k)
+			nextg = time.Unix(0, gend).UTC().Format(time.RFC3339Nano)
+		}
+		info = append(info, di)
 		atomic.AddInt32(&q.totalKeys, 1)
+
+		return err
 	}, nil)
+
+	if err == nil && len(info) > 0 {
+		issue(nil)
+	}
+
+	q.cherr <- err
+}
+
+func (q *queryIn) getGrouper() grouper {
+	if q.grouper != nil {
+		return q.grouper
+	}
+	if q.group == 0 {
+		return nil
+	}
+	return fixedGroup(time.Duration(q.group) * time.Millisecond)
+}
+
+var processorInput chan *processIn
+var queryInput chan *queryIn
+
+func queryExecutor() {
+	for q := range queryInput {
+		if time.Now().Before(q.before) {
+			runQuery(q)
+		} else {
+			log.Printf("timed out query that's %v late", time.Since(q.before))
+			q.cherr <- errTimeout
+		}
+	}
+}
+
+// submit hands q to the query executors.
+func (q *queryIn) submit() {
+	q.out = make(chan *processOut)
+	q.cherr = make(chan error, 1)
+	if q.start.IsZero() {
+		q.start = time.Now()
+	}
+	if q.before.IsZero() {
+		cfg, _ := dbReadConfig(q.dbname)
+		q.before = q.start.Add(cfg.queryTimeout())
+	}
+	queryInput <- q
+}
+
+// collectQuery submits q to the query executors and gathers the output
+// of every group it starts, keyed by group, filling empty groups as
+// q.fill requests.
+func collectQuery(q *queryIn) (map[int64]*processOut, error) {
+	if !fillPolicies[q.fill] {
+		return nil, fmt.Errorf("unknown fill policy: %v", q.fill)
+	}
+	q.submit()
+
+	rv := map[int64]*processOut{}
+	var err error
+	going := true
+	started, finished := int32(0), int32(0)
+	collect := func(timeout <-chan time.Time) bool {
+		for going || finished < started {
+			select {
+			case po := <-q.out:
+				finished++
+				if po.err != nil {
+					err = po.err
+				} else {
+					rv[po.key] = po
+				}
+			case qerr := <-q.cherr:
+				going = false
+				if qerr != nil {
+					err = qerr
+				}
+				started = atomic.LoadInt32(&q.started)
+			case <-timeout:
+				return false
+			}
+		}
+		return true
+	}
+
+	t := time.NewTimer(time.Until(q.before))
+	defer t.Stop()
+	if !collect(t.C) {
+		// let the outstanding groups finish without anyone waiting
+		go collect(nil)
+		return nil, errTimeout
+	}
+	if err == nil {
+		err = fillGroups(rv, q.getGrouper(), q.from, q.to, q.fill, len(q.ptrs))
+	}
+	return rv, err
 }
 
-var reducers = map[string]reducer{
+// streamQuery submits q and passes each group's output to emit in key
+// order, as soon as it and every earlier group are done. Only groups
+// that finish out of order are held.
+func streamQuery(q *queryIn, emit func(po *processOut) error) error {
+	q.keys = make(chan int64)
+	q.submit()
+
+	pending := map[int64]*processOut{}
+	order := []int64{}
+	var err error
+	going := true
+	started, finished := 0, 0
+	// runQuery sends every key before its result, so once the result
+	// arrives started is final
+	collect := func(timeout <-chan time.Time) bool {
+		for going || finished < started {
+			select {
+			case k := <-q.keys:
+				started++
+				order = append(order, k)
+			case po := <-q.out:
+				finished++
+				pending[po.key] = po
+			case qerr := <-q.cherr:
+				going = false
+				if qerr != nil && err == nil {
+					err = qerr
+				}
+			case <-timeout:
+				return false
+			}
+			for err == nil && len(order) > 0 && pending[order[0]] != nil {
+				po := pending[order[0]]
+				delete(pending, order[0])
+				order = order[1:]
+				if po.err != nil {
+					err = po.err
+				} else {
+					err = emit(po)
+				}
+			}
+			if err != nil && timeout != nil {
+				return false
+			}
+		}
+		return true
+	}
 
-}
\ No newline at end of file
+	t := time.NewTimer(time.Until(q.before))
+	defer t.Stop()
+	if !collect(t.C) {
+		rv := err
+		if rv == nil {
+			rv = errTimeout
+		}
+		// let the outstanding groups finish without anyone waiting
+		go collect(nil)
+		return rv
+	}
+	return err
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errReducerExists = errors.New("reducer already registered")
+var errReducerName = errors.New("reducer name can't be empty")
+
+var reducerLock = sync.RWMutex{}
+
+// registerReducer makes r available to queries under name.
+func registerReducer(name string, r reducer) error {
+	if name == "" {
+		return errReducerName
+	}
+	reducerLock.Lock()
+	defer reducerLock.Unlock()
+	if _, ok := reducers[name]; ok {
+		return errReducerExists
+	}
+	reducers[name] = r
+	return nil
+}
+
+// A reducerFactory builds a reducer from the argument following the
+// colon in a parameterized reducer name such as "quantile:0.95".
+type reducerFactory func(arg string) (reducer, error)
+
+// registerReducerFactory makes name:arg reducers available to queries.
+func registerReducerFactory(name string, f reducerFactory) error {
+	if name == "" {
+		return errReducerName
+	}
+	reducerLock.Lock()
+	defer reducerLock.Unlock()
+	if _, ok := reducerFactories[name]; ok {
+		return errReducerExists
+	}
+	reducerFactories[name] = f
+	return nil
+}
+
+func lookupReducer(name string) (reducer, bool) {
+	reducerLock.RLock()
+	defer reducerLock.RUnlock()
+	r, ok := reducers[name]
+	if ok {
+		return r, true
+	}
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	f, ok := reducerFactories[parts[0]]
+	if !ok {
+		return nil, false
+	}
+	r, err := f(parts[1])
+	return r, err == nil
+}
+
+func parseFloat(val interface{}) (float64, bool) {
+	switch x := val.(type) {
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	case float64:
+		return x, true
+	case int:
+		return float64(x), true
+	}
+	return 0, false
+}
+
+// convertTofloat64 emits every numeric value included in the group.
+func convertTofloat64(in chan ptrval) chan float64 {
+	ch := make(chan float64)
+	go func() {
+		defer close(ch)
+		for v := range in {
+			if !v.included {
+				continue
+			}
+			if f, ok := parseFloat(v.val); ok {
+				ch <- f
+			}
+		}
+	}()
+	return ch
+}
+
+type tsval struct {
+	ts  int64
+	val float64
+}
+
+// convertToPoints emits the timestamp and numeric value of every
+// document, including the first document of the next group so rates
+// can span the whole group.
+func convertToPoints(in chan ptrval) chan tsval {
+	ch := make(chan tsval)
+	go func() {
+		defer close(ch)
+		for v := range in {
+			if v.di == nil {
+				continue
+			}
+			f, ok := parseFloat(v.val)
+			if !ok {
+				continue
+			}
+			ts := parseKeys(v.di.ID)
+			if ts < 0 {
+				continue
+			}
+			ch <- tsval{ts, f}
+		}
+	}()
+	return ch
+}
+
+// convertTofloat64Rate emits the per-second change between each pair
+// of consecutive numeric values.
+func convertTofloat64Rate(in chan ptrval) chan float64 {
+	ch := make(chan float64)
+	go func() {
+		defer close(ch)
+		var prev tsval
+		seen := false
+		for p := range convertToPoints(in) {
+			if seen && p.ts > prev.ts {
+				ch <- (p.val - prev.val) / (float64(p.ts-prev.ts) / 1e9)
+			}
+			prev, seen = p, true
+		}
+	}()
+	return ch
+}
+
+// rateOf computes the per-second change over every interval delta
+// accepts, with delta deciding how a drop in value is treated.
+func rateOf(in chan ptrval, delta func(prev, cur float64) (float64, bool)) interface{} {
+	var prev tsval
+	seen := false
+	total, elapsed := float64(0), int64(0)
+	for p := range convertToPoints(in) {
+		if seen && p.ts > prev.ts {
+			if d, ok := delta(prev.val, p.val); ok {
+				total += d
+				elapsed += p.ts - prev.ts
+			}
+		}
+		prev, seen = p, true
+	}
+	if elapsed == 0 {
+		return math.NaN()
+	}
+	return total / (float64(elapsed) / 1e9)
+}
+
+func minOf(in chan float64) interface{} {
+	rv := math.NaN()
+	for v := range in {
+		if math.IsNaN(rv) || v < rv {
+			rv = v
+		}
+	}
+	return rv
+}
+
+func maxOf(in chan float64) interface{} {
+	rv := math.NaN()
+	for v := range in {
+		if math.IsNaN(rv) || v > rv {
+			rv = v
+		}
+	}
+	return rv
+}
+
+func avgOf(in chan float64) interface{} {
+	count, sum := 0, float64(0)
+	for v := range in {
+		count++
+		sum += v
+	}
+	return sum / float64(count)
+}
+
+func quantileReducer(q float64) reducer {
+	return func(input chan ptrval) interface{} {
+		td := newTDigest(defaultCompression)
+		for v := range convertTofloat64(input) {
+			td.add(v)
+		}
+		return td.quantile(q)
+	}
+}
+
+func parseQuantile(arg string) (reducer, error) {
+	q, err := strconv.ParseFloat(arg, 64)
+	if err != nil || q < 0 || q > 1 {
+		return nil, fmt.Errorf("invalid quantile: %v", arg)
+	}
+	return quantileReducer(q), nil
+}
+
+func parsePercentile(arg string) (reducer, error) {
+	p, err := strconv.ParseFloat(arg, 64)
+	if err != nil || p < 0 || p > 100 {
+		return nil, fmt.Errorf("invalid percentile: %v", arg)
+	}
+	return quantileReducer(p / 100), nil
+}
+
+var reducerFactories = map[string]reducerFactory{}
+
+var reducers = map[string]reducer{
+	"any": func(input chan ptrval) interface{} {
+		var rv interface{}
+		for v := range input {
+			if rv == nil && v.included {
+				rv = v.val
+			}
+		}
+		return rv
+	},
+	"count": func(input chan ptrval) interface{} {
+		rv := 0
+		for v := range input {
+			if v.included && v.val != nil {
+				rv++
+			}
+		}
+		return rv
+	},
+	"sum": func(input chan ptrval) interface{} {
+		rv := float64(0)
+		for v := range convertTofloat64(input) {
+			rv += v
+		}
+		return rv
+	},
+	"sumsq": func(input chan ptrval) interface{} {
+		rv := float64(0)
+		for v := range convertTofloat64(input) {
+			rv += v * v
+		}
+		return rv
+	},
+	"min": func(input chan ptrval) interface{} {
+		return minOf(convertTofloat64(input))
+	},
+	"max": func(input chan ptrval) interface{} {
+		return maxOf(convertTofloat64(input))
+	},
+	"avg": func(input chan ptrval) interface{} {
+		return avgOf(convertTofloat64(input))
+	},
+	"c_min": func(input chan ptrval) interface{} {
+		return minOf(convertTofloat64Rate(input))
+	},
+	"c_max": func(input chan ptrval) interface{} {
+		return maxOf(convertTofloat64Rate(input))
+	},
+	"c_avg": func(input chan ptrval) interface{} {
+		return avgOf(convertTofloat64Rate(input))
+	},
+	"first": func(input chan ptrval) interface{} {
+		var rv interface{}
+		found := false
+		for v := range input {
+			if !found && v.included && v.val != nil {
+				rv, found = v.val, true
+			}
+		}
+		return rv
+	},
+	"last": func(input chan ptrval) interface{} {
+		var rv interface{}
+		for v := range input {
+			if v.included && v.val != nil {
+				rv = v.val
+			}
+		}
+		return rv
+	},
+	"distinct": func(input chan ptrval) interface{} {
+		seen := map[interface{}]bool{}
+		rv := []interface{}{}
+		for v := range input {
+			if !v.included || v.val == nil {
+				continue
+			}
+			switch v.val.(type) {
+			case map[string]interface{}, []interface{}:
+				// maps and slices aren't comparable, keep them all
+				rv = append(rv, v.val)
+			default:
+				if !seen[v.val] {
+					seen[v.val] = true
+					rv = append(rv, v.val)
+				}
+			}
+		}
+		return rv
+	},
+	"identity": func(input chan ptrval) interface{} {
+		rv := []interface{}{}
+		for v := range input {
+			if v.included {
+				rv = append(rv, v.val)
+			}
+		}
+		return rv
+	},
+	"rate": func(input chan ptrval) interface{} {
+		return rateOf(input, func(prev, cur float64) (float64, bool) {
+			if cur < prev {
+				// counter reset, assume it restarted from zero
+				return cur, true
+			}
+			return cur - prev, true
+		})
+	},
+	"derivative": func(input chan ptrval) interface{} {
+		return rateOf(input, func(prev, cur float64) (float64, bool) {
+			return cur - prev, true
+		})
+	},
+	"non_negative_derivative": func(input chan ptrval) interface{} {
+		return rateOf(input, func(prev, cur float64) (float64, bool) {
+			return cur - prev, cur >= prev
+		})
+	},
+}
+
+// The sketch-backed reducers are registered the way an embedder would
+// add its own.
+func init() {
+	for name, q := range map[string]float64{
+		"median": 0.5,
+		"p50":    0.5,
+		"p75":    0.75,
+		"p90":    0.9,
+		"p95":    0.95,
+		"p99":    0.99,
+		"p999":   0.999,
+	} {
+		if err := registerReducer(name, quantileReducer(q)); err != nil {
+			log.Panicf("error registering reducer %v: %v", name, err)
+		}
+	}
+	for name, f := range map[string]reducerFactory{
+		"quantile":   parseQuantile,
+		"percentile": parsePercentile,
+	} {
+		if err := registerReducerFactory(name, f); err != nil {
+			log.Panicf("error registering reducer %v: %v", name, err)
+		}
+	}
+}
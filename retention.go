@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var errBatchFull = errors.New("batch full")
+
+// expireDB deletes every document of dbname older than its retention,
+// a queue's worth at a time, compacting afterwards if anything was
+// removed.
+func expireDB(dbname string, now time.Time) (int, error) {
+	cfg, err := dbReadConfig(dbname)
+	if err != nil {
+		return 0, err
+	}
+	keep := cfg.retention()
+	if keep == 0 {
+		return 0, nil
+	}
+	cutoff := now.Add(-keep).UTC()
+	to := cutoff.Format(time.RFC3339Nano)
+
+	n := 0
+	from := ""
+	for {
+		keys := []string{}
+		err = dbwalkkeys(dbname, from, to, func(k string) error {
+			if ts := parseKeys(k); ts >= 0 && ts < cutoff.UnixNano() {
+				keys = append(keys, k)
+			}
+			if len(keys) >= cfg.maxOpQueue() {
+				return errBatchFull
+			}
+			return nil
+		})
+		if err != nil && err != errBatchFull {
+			return n, err
+		}
+		if len(keys) == 0 {
+			break
+		}
+		items := make([]dbqitem, len(keys))
+		for i, k := range keys {
+			items[i] = dbqitem{k: k, op: opDeleteItem}
+		}
+		if errs := dbwriteall(dbname, items); len(errs) > 0 {
+			return n, errs[0]
+		}
+		n += len(keys)
+		if err != errBatchFull {
+			break
+		}
+		from = keys[len(keys)-1] + "\x00"
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, dbcompact(dbname)
+}
+
+func retentionLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, dbname := range dblist(*dbRoot) {
+			start := time.Now()
+			n, err := expireDB(dbname, start)
+			if err != nil {
+				log.Printf("error expiring %v: %v", dbname, err)
+			} else if n > 0 {
+				log.Printf("expired %d items from %v in %v", n, dbname, time.Since(start))
+			}
+		}
+	}
+}
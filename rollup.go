@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const rollupMarksExt = ".rollups"
+
+// A single run rolls up at most this many groups, so catching up on a
+// long history doesn't run into the query timeout.
+const maxRollupGroups = 1000
+
+var validDBName = regexp.MustCompile("^" + dbMatch + "$")
+
+// A rollupRule continuously queries its database over completed groups
+// and stores one document per group, holding every series by name, in
+// the target database.
+type rollupRule struct {
+	Target    string       `json:"target"`
+	Group     interface{}  `json:"group"`
+	TZ        string       `json:"tz,omitempty"`
+	WeekStart string       `json:"weekstart,omitempty"`
+	Series    []jsonSeries `json:"series"`
+}
+
+func (r rollupRule) query() *jsonQuery {
+	return &jsonQuery{
+		Group:     r.Group,
+		TZ:        r.TZ,
+		WeekStart: r.WeekStart,
+		Series:    append([]jsonSeries{}, r.Series...),
+	}
+}
+
+func validateRollups(source string, rules []rollupRule) error {
+	seen := map[string]bool{}
+	for _, r := range rules {
+		if !validDBName.MatchString(r.Target) {
+			return fmt.Errorf("invalid rollup target: %q", r.Target)
+		}
+		if r.Target == source {
+			return fmt.Errorf("rollup target must differ from its source")
+		}
+		if seen[r.Target] {
+			return fmt.Errorf("duplicate rollup target: %v", r.Target)
+		}
+		seen[r.Target] = true
+		if _, _, err := r.query().compile(source); err != nil {
+			return fmt.Errorf("rollup %v: %v", r.Target, err)
+		}
+	}
+	return nil
+}
+
+// The high-water marks of a database's rollups, by target, record the
+// start of the first group each has yet to store.
+func rollupMarksPath(name string) string {
+	return filepath.Join(*dbRoot, name) + rollupMarksExt
+}
+
+func readRollupMarks(name string) (map[string]int64, error) {
+	rv := map[string]int64{}
+	b, err := ioutil.ReadFile(rollupMarksPath(name))
+	if os.IsNotExist(err) {
+		return rv, nil
+	}
+	if err != nil {
+		return rv, err
+	}
+	err = json.Unmarshal(b, &rv)
+	return rv, err
+}
+
+func writeRollupMarks(name string, marks map[string]int64) error {
+	b, err := json.Marshal(marks)
+	if err != nil {
+		return err
+	}
+	path := rollupMarksPath(name)
+	if err := ioutil.WriteFile(path+".tmp", b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+var errFoundKey = errors.New("found key")
+
+// firstKey is the timestamp of the oldest document in dbname, or -1 if
+// it's empty.
+func firstKey(dbname string) (int64, error) {
+	rv := int64(-1)
+	err := dbwalkkeys(dbname, "", "", func(k string) error {
+		if ts := parseKeys(k); ts >= 0 {
+			rv = ts
+			return errFoundKey
+		}
+		return nil
+	})
+	if err == errFoundKey {
+		err = nil
+	}
+	return rv, err
+}
+
+// runRollup stores the groups of r completed since its high-water mark,
+// returning how many it stored.
+func runRollup(source string, r rollupRule, now time.Time) (int, error) {
+	marks, err := readRollupMarks(source)
+	if err != nil {
+		return 0, err
+	}
+	jq := r.query()
+	g, err := jq.grouper()
+	if err != nil {
+		return 0, err
+	}
+	current, _ := g.bucket(now.UnixNano())
+
+	from, ok := marks[r.Target]
+	if !ok {
+		first, err := firstKey(source)
+		if err != nil || first < 0 {
+			return 0, err
+		}
+		from, _ = g.bucket(first)
+	}
+	to := from
+	for i := 0; i < maxRollupGroups && to < current; i++ {
+		_, to = g.bucket(to)
+	}
+	if to > current {
+		to = current
+	}
+	if to <= from {
+		return 0, nil
+	}
+
+	jq.From = time.Unix(0, from).UTC().Format(time.RFC3339Nano)
+	jq.To = time.Unix(0, to-1).UTC().Format(time.RFC3339Nano)
+	queries, refs, err := jq.compile(source)
+	if err != nil {
+		return 0, err
+	}
+	results, err := jq.run(queries, refs)
+	if err != nil {
+		return 0, err
+	}
+
+	docs := map[int64]map[string]interface{}{}
+	for name, byKey := range results {
+		for k, v := range byKey {
+			if docs[k] == nil {
+				docs[k] = map[string]interface{}{}
+			}
+			docs[k][name] = v
+		}
+	}
+	if len(docs) > 0 {
+		if _, err := os.Stat(dbPath(r.Target)); os.IsNotExist(err) {
+			if err := dbcreate(dbPath(r.Target)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	items := []dbqitem{}
+	for k, doc := range docs {
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return 0, err
+		}
+		items = append(items, dbqitem{k: time.Unix(0, k).UTC().Format(time.RFC3339Nano),
+			data: b, op: opStoreItem})
+	}
+	// the mark only moves once the groups are committed, so a crash
+	// before then rolls them up again
+	for _, err := range dbwriteall(r.Target, items) {
+		// a target that rejects collisions already has this group
+		if err != errDuplicateKey {
+			return 0, err
+		}
+	}
+
+	marks[r.Target] = to
+	return len(docs), writeRollupMarks(source, marks)
+}
+
+func rollupLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, dbname := range dblist(*dbRoot) {
+			cfg, err := dbReadConfig(dbname)
+			if err != nil {
+				log.Printf("error reading config of %v: %v", dbname, err)
+				continue
+			}
+			for _, r := range cfg.Rollups {
+				start := time.Now()
+				n, err := runRollup(dbname, r, start)
+				if err != nil {
+					log.Printf("error rolling up %v into %v: %v", dbname, r.Target, err)
+				} else if n > 0 {
+					log.Printf("rolled up %d groups from %v into %v in %v",
+						n, dbname, r.Target, time.Since(start))
+				}
+			}
+		}
+	}
+}
+
+func getRollups(parts []string, w http.ResponseWriter, req *http.Request) {
+	if _, err := os.Stat(dbPath(parts[0])); err != nil {
+		emitError(404, w, "not_found", "no such database")
+		return
+	}
+	cfg, err := dbReadConfig(parts[0])
+	if err != nil {
+		emitError(500, w, "config_error", err.Error())
+		return
+	}
+	marks, err := readRollupMarks(parts[0])
+	if err != nil {
+		emitError(500, w, "config_error", err.Error())
+		return
+	}
+	rules := cfg.Rollups
+	if rules == nil {
+		rules = []rollupRule{}
+	}
+	done := map[string]string{}
+	for target, ts := range marks {
+		done[target] = time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+	mustEncode(200, w, map[string]interface{}{"rollups": rules, "through": done})
+}
+
+func putRollups(parts []string, w http.ResponseWriter, req *http.Request) {
+	if _, err := os.Stat(dbPath(parts[0])); err != nil {
+		emitError(404, w, "not_found", "no such database")
+		return
+	}
+	in := struct {
+		Rollups []rollupRule `json:"rollups"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		emitError(400, w, "bad_request", err.Error())
+		return
+	}
+	emitConfigUpdate(w, updateConfig(parts[0], func(c *dbConfig) error {
+		c.Rollups = in.Rollups
+		return nil
+	}))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Writes spilled from a full queue wait in a file next to the write-ahead
+// log, in the same records. Once one has spilled, later writes spill
+// behind it until the writer has committed them all, so writes are
+// stored in the order they came. A spill left by a crash is replayed
+// after the log.
+
+const spillExt = ".spill"
+
+func spillPath(dbname string) string {
+	return filepath.Join(*dbRoot, dbname) + spillExt
+}
+
+// A spillWaiter is a sync write in the spill, found by where its
+// record ends.
+type spillWaiter struct {
+	end   int64
+	cherr chan error
+	key   *string
+}
+
+func (w *dbWriter) isSpilling() bool {
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+	return w.spilling
+}
+
+// spillBehind spills qi if earlier writes are still spilled, reporting
+// whether it did.
+func (w *dbWriter) spillBehind(qi dbqitem) (bool, error) {
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+	if !w.spilling {
+		return false, nil
+	}
+	return true, w.spillLocked(qi)
+}
+
+// spill appends qi to the spill, which the writer then gets to once
+// its queue has drained.
+func (w *dbWriter) spill(qi dbqitem) error {
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+	return w.spillLocked(qi)
+}
+
+func (w *dbWriter) spillLocked(qi dbqitem) error {
+	if w.spillClosed {
+		return errClosed
+	}
+	if w.spillFile == nil {
+		f, err := os.OpenFile(spillPath(w.dbname), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		w.spillFile = f
+	}
+	b := encodeWALRecord(qi)
+	if _, err := w.spillFile.Write(b); err != nil {
+		// don't leave a torn record ahead of later ones
+		w.spillFile.Truncate(w.spillSize)
+		return err
+	}
+	if qi.cherr != nil {
+		if err := w.spillFile.Sync(); err != nil {
+			return err
+		}
+	}
+	w.spillSize += int64(len(b))
+	w.spilling = true
+	if qi.cherr != nil {
+		w.spillWaiting = append(w.spillWaiting, spillWaiter{w.spillSize, qi.cherr, qi.key})
+	}
+	atomic.AddUint64(&w.stats.spilled, 1)
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// readSpill hands the writer up to max spilled writes it hasn't had,
+// reporting whether it's had them all.
+func (w *dbWriter) readSpill(max int, f func(qi dbqitem)) (bool, error) {
+	w.spillMu.Lock()
+	size := w.spillSize
+	w.spillMu.Unlock()
+	if w.spillRead >= size {
+		return true, nil
+	}
+	sf, err := os.Open(spillPath(w.dbname))
+	if err != nil {
+		return false, err
+	}
+	defer sf.Close()
+	r := bufio.NewReader(io.NewSectionReader(sf, w.spillRead, size-w.spillRead))
+	for i := 0; i < max && w.spillRead < size; i++ {
+		qi, n, err := readWALRecord(r)
+		if err != nil {
+			// what's left can't be read, so skip it
+			w.spillRead = size
+			if err == io.EOF {
+				err = errBadWALRecord
+			}
+			w.spillMu.Lock()
+			for len(w.spillWaiting) > 0 && w.spillWaiting[0].end <= size {
+				w.spillWaiting[0].cherr <- err
+				w.spillWaiting = w.spillWaiting[1:]
+			}
+			w.spillMu.Unlock()
+			return true, err
+		}
+		w.spillRead += int64(n)
+		w.spillMu.Lock()
+		if len(w.spillWaiting) > 0 && w.spillWaiting[0].end == w.spillRead {
+			qi.cherr, qi.key = w.spillWaiting[0].cherr, w.spillWaiting[0].key
+			w.spillWaiting = w.spillWaiting[1:]
+		}
+		w.spillMu.Unlock()
+		f(qi)
+	}
+	return w.spillRead >= size, nil
+}
+
+// endSpill removes the spill once the writer has committed everything
+// in it, letting writes queue again. It reports false if more have
+// spilled since.
+func (w *dbWriter) endSpill() bool {
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+	if w.spillRead < w.spillSize {
+		return false
+	}
+	if w.spillFile != nil {
+		w.spillFile.Close()
+		w.spillFile = nil
+		os.Remove(spillPath(w.dbname))
+	}
+	w.spillSize, w.spillRead = 0, 0
+	w.spilling = false
+	return true
+}
+
+// closeSpill stops spilling, leaving what's spilled to be replayed when
+// the database is next opened, and tells sync writers in it that they
+// weren't committed.
+func (w *dbWriter) closeSpill() {
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+	w.spillClosed = true
+	if w.spillFile != nil {
+		w.spillFile.Close()
+		w.spillFile = nil
+	}
+	for _, sw := range w.spillWaiting {
+		sw.cherr <- errClosed
+	}
+	w.spillWaiting = nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// A tdigest is a merging t-digest sketch: it estimates quantiles of a
+// stream in memory bounded by its compression, not the stream length.
+
+type centroid struct {
+	mean, count float64
+}
+
+type byMean []centroid
+
+func (c byMean) Len() int           { return len(c) }
+func (c byMean) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byMean) Less(i, j int) bool { return c[i].mean < c[j].mean }
+
+type tdigest struct {
+	compression float64
+	centroids   []centroid
+	buf         []centroid
+	count       float64
+	min, max    float64
+}
+
+const defaultCompression = 100
+
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{
+		compression: compression,
+		buf:         make([]centroid, 0, int(compression)*4),
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+func (t *tdigest) add(x float64) {
+	if math.IsNaN(x) {
+		return
+	}
+	t.buf = append(t.buf, centroid{x, 1})
+	t.count++
+	t.min = math.Min(t.min, x)
+	t.max = math.Max(t.max, x)
+	if len(t.buf) == cap(t.buf) {
+		t.compress()
+	}
+}
+
+func (t *tdigest) compress() {
+	if len(t.buf) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buf...)
+	sort.Sort(byMean(all))
+
+	merged := make([]centroid, 0, len(t.centroids)+1)
+	cur := all[0]
+	sofar := float64(0)
+	for _, c := range all[1:] {
+		q := (sofar + (cur.count+c.count)/2) / t.count
+		limit := 4 * t.count * q * (1 - q) / t.compression
+		if cur.count+c.count <= limit {
+			cur.mean += (c.mean - cur.mean) * c.count / (cur.count + c.count)
+			cur.count += c.count
+		} else {
+			sofar += cur.count
+			merged = append(merged, cur)
+			cur = c
+		}
+	}
+	t.centroids = append(merged, cur)
+	t.buf = t.buf[:0]
+}
+
+// quantile estimates the value at q (0 <= q <= 1), or NaN if nothing
+// has been added.
+func (t *tdigest) quantile(q float64) float64 {
+	t.compress()
+	switch {
+	case len(t.centroids) == 0:
+		return math.NaN()
+	case len(t.centroids) == 1 || q <= 0:
+		if q >= 1 {
+			return t.max
+		}
+		if q <= 0 {
+			return t.min
+		}
+		return t.centroids[0].mean
+	case q >= 1:
+		return t.max
+	}
+
+	target := q * t.count
+	sofar := float64(0)
+	for i, c := range t.centroids {
+		mid := sofar + c.count/2
+		if target < mid {
+			if i == 0 {
+				return t.min + (c.mean-t.min)*target/mid
+			}
+			prev := t.centroids[i-1]
+			prevmid := sofar - prev.count/2
+			return prev.mean + (c.mean-prev.mean)*(target-prevmid)/(mid-prevmid)
+		}
+		sofar += c.count
+	}
+	last := t.centroids[len(t.centroids)-1]
+	lastmid := t.count - last.count/2
+	return last.mean + (t.max-last.mean)*(target-lastmid)/(t.count-lastmid)
+}
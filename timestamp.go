@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"series/timelib"
+	"time"
+
+	"github.com/dustin/go-jsonpointer"
+)
+
+// docTimestamp returns the key for the timestamp found at ptr in a
+// document, or "" if there's none.
+func docTimestamp(body []byte, ptr string) (string, error) {
+	raw, err := jsonpointer.Find(body, ptr)
+	if err != nil {
+		return "", err
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	s := string(raw)
+	if raw[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", err
+		}
+	} else if raw[0] == '{' || raw[0] == '[' {
+		return "", fmt.Errorf("timestamp at %v isn't a string or number", ptr)
+	}
+	t, err := timelib.ParseTime(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp at %v: %v", ptr, err)
+	}
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
+
+// requiredTimestamp is docTimestamp for documents that must have one.
+func requiredTimestamp(body []byte, ptr string) (string, error) {
+	k, err := docTimestamp(body, ptr)
+	if err == nil && k == "" {
+		err = fmt.Errorf("missing timestamp at %v", ptr)
+	}
+	return k, err
+}
+
+// timestampPtr is where a write request's documents keep their
+// timestamps: the ts parameter, or else the database's setting.
+func timestampPtr(req *http.Request, cfg dbConfig) string {
+	if ptr := req.FormValue("ts"); ptr != "" {
+		return ptr
+	}
+	return cfg.TimestampPtr
+}
+
+// dbTimestampPtr is where dbname's documents keep their timestamps, if
+// it says.
+func dbTimestampPtr(dbname string) (string, error) {
+	writer, _, err := getOrCreateDB(dbname)
+	if err != nil {
+		return "", err
+	}
+	return writer.settings().TimestampPtr, nil
+}
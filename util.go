@@ -1 +1,34 @@
 package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// syncWrite reports whether a write request asked, with ?sync=true, to
+// be acknowledged only once it's committed.
+func syncWrite(req *http.Request) bool {
+	b, _ := strconv.ParseBool(req.FormValue("sync"))
+	return b
+}
+
+// retryAfter is how long a client should wait before retrying a write
+// rejected by a full queue: about as long as the queue takes to flush.
+func retryAfter(dbname string) time.Duration {
+	cfg, _ := dbReadConfig(dbname)
+	return cfg.flushDelay()
+}
+
+// emitWriteError reports a failed write, asking the client to come back
+// later if the write queue was full.
+func emitWriteError(w http.ResponseWriter, dbname string, err error) {
+	if err == errQueueFull {
+		secs := math.Ceil(retryAfter(dbname).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(secs, 1))))
+		emitError(503, w, "queue_full", err.Error())
+		return
+	}
+	emitError(500, w, "write_error", err.Error())
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mschoch/gouchstore"
+)
+
+// With -wal, writes are logged before they're queued, so items the
+// writer hasn't committed yet survive a crash. The log of a database is
+// a series of numbered segments; every commit starts a new one, and a
+// segment is removed once everything logged in it has been committed.
+// Segments left behind are replayed when the database is next opened.
+//
+// Records are handed to the operating system without waiting for the
+// disk, so they survive the process dying but not the machine losing
+// power. Sync writes are flushed to disk before they're queued.
+
+const walExt = ".wal"
+
+var errBadWALRecord = errors.New("bad write-ahead log record")
+
+type writeAheadLog struct {
+	dbname  string
+	mu      sync.Mutex
+	gen     uint64
+	f       *os.File
+	pending map[uint64]int
+	closed  bool
+}
+
+func walSegment(dbname string, gen uint64) string {
+	return filepath.Join(*dbRoot, dbname) + walExt + "." + strconv.FormatUint(gen, 10)
+}
+
+// walSegments lists the generations of dbname's log segments in order.
+func walSegments(dbname string) ([]uint64, error) {
+	prefix := filepath.Join(*dbRoot, dbname) + walExt + "."
+	paths, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	rv := []uint64{}
+	for _, p := range paths {
+		if gen, err := strconv.ParseUint(strings.TrimPrefix(p, prefix), 10, 64); err == nil {
+			rv = append(rv, gen)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i] < rv[j] })
+	return rv, nil
+}
+
+// A record is its payload's length and checksum followed by the
+// payload: the operation, the key's length, the key and the data.
+func encodeWALRecord(qi dbqitem) []byte {
+	payload := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(qi.k)+len(qi.data))
+	payload[0] = byte(qi.op)
+	n := binary.PutUvarint(payload[1:], uint64(len(qi.k)))
+	payload = append(payload[:1+n], qi.k...)
+	payload = append(payload, qi.data...)
+
+	rv := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(rv, uint32(len(payload)))
+	binary.BigEndian.PutUint32(rv[4:], crc32.ChecksumIEEE(payload))
+	return append(rv, payload...)
+}
+
+// readWALRecord reads a record and its length, returning io.EOF at
+// the end of a log. A torn record at the end, from a crash mid-write,
+// ends the log, as does the zeroed space a crash can leave after the
+// last record.
+func readWALRecord(r io.Reader) (dbqitem, int, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return dbqitem{}, 0, io.EOF
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(hdr))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return dbqitem{}, 0, io.EOF
+	}
+	if len(payload) == 0 || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:]) {
+		return dbqitem{}, 0, io.EOF
+	}
+	klen, n := binary.Uvarint(payload[1:])
+	if n <= 0 || uint64(len(payload)-1-n) < klen {
+		return dbqitem{}, 0, errBadWALRecord
+	}
+	return dbqitem{
+		op:   dbOperation(payload[0]),
+		k:    string(payload[1+n : 1+n+int(klen)]),
+		data: payload[1+n+int(klen):],
+	}, len(hdr) + len(payload), nil
+}
+
+// readWALSegment calls f with each record of a segment, stopping at
+// the first error.
+func readWALSegment(path string, f func(op dbOperation, k string, data []byte) error) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(b)
+	for {
+		qi, _, err := readWALRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(qi.op, qi.k, qi.data); err != nil {
+			return err
+		}
+	}
+}
+
+// replayWAL commits everything left in dbname's log, followed by any
+// writes it spilled, which came after, to db and removes them,
+// returning the generation to log to next. Stores are resolved under
+// the database's collision policy as the writer would have, skipping
+// those a crash after their commit left in the log: the rejected, and
+// under sequence, those whose body is already at their key or one of
+// its sequence keys.
+func replayWAL(dbname string, db *gouchstore.Gouchstore, collisions string) (uint64, error) {
+	gens, err := walSegments(dbname)
+	if err != nil {
+		return 1, err
+	}
+	paths := []string{}
+	for _, gen := range gens {
+		paths = append(paths, walSegment(dbname, gen))
+	}
+	if _, err := os.Stat(spillPath(dbname)); err == nil {
+		paths = append(paths, spillPath(dbname))
+	}
+	next := uint64(1)
+	if len(gens) > 0 {
+		next = gens[len(gens)-1] + 1
+	}
+	if len(paths) == 0 {
+		return next, nil
+	}
+
+	bulk := db.Bulk()
+	defer bulk.Close()
+	n := 0
+	// bodies written since the last commit, which loses the order of
+	// writes to the same key
+	batch := map[string][]byte{}
+	for _, path := range paths {
+		err := readWALSegment(path, func(op dbOperation, k string, data []byte) error {
+			switch op {
+			case opStoreItem:
+				if collisions == "sequence" && sequenced(db, batch, k, data) {
+					return nil
+				}
+				if collisions != "overwrite" {
+					var err error
+					k, data, _, err = resolveCollision(db, collisions, batch, k, data)
+					if err == errDuplicateKey {
+						return nil
+					}
+					if err != nil {
+						log.Printf("error replaying %v into %v: %v", k, dbname, err)
+						return nil
+					}
+				}
+			case opDeleteItem:
+				data = nil
+			default:
+				return nil
+			}
+			if _, ok := batch[k]; ok {
+				if err := bulk.Commit(); err != nil {
+					return err
+				}
+				batch = map[string][]byte{}
+			}
+			batch[k] = data
+			if op == opStoreItem {
+				bulk.Set(gouchstore.NewDocumentInfo(k), gouchstore.NewDocument(k, data))
+			} else {
+				bulk.Delete(gouchstore.NewDocumentInfo(k))
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := bulk.Commit(); err != nil {
+		return 0, err
+	}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	log.Printf("replayed %d items from the write-ahead log of %v", n, dbname)
+	return next, nil
+}
+
+// replayWALs opens every database with a log or spill left behind,
+// replaying it.
+func replayWALs() {
+	for _, dbname := range dblist(*dbRoot) {
+		gens, _ := walSegments(dbname)
+		_, err := os.Stat(spillPath(dbname))
+		if len(gens) > 0 || err == nil {
+			if _, _, err := getOrCreateDB(dbname); err != nil {
+				log.Printf("error replaying write-ahead log of %v: %v", dbname, err)
+			}
+		}
+	}
+}
+
+func removeWAL(dbname string) {
+	gens, _ := walSegments(dbname)
+	for _, gen := range gens {
+		os.Remove(walSegment(dbname, gen))
+	}
+	os.Remove(spillPath(dbname))
+}
+
+func newWAL(dbname string, gen uint64) *writeAheadLog {
+	return &writeAheadLog{dbname: dbname, gen: gen, pending: map[uint64]int{}}
+}
+
+// append logs qi, noting in it the segment it went to. A sync write
+// is on disk when it returns.
+func (l *writeAheadLog) append(qi *dbqitem) error {
+	b := encodeWALRecord(*qi)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errClosed
+	}
+	if l.f == nil {
+		f, err := os.OpenFile(walSegment(l.dbname, l.gen),
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		l.f = f
+	}
+	if _, err := l.f.Write(b); err != nil {
+		return err
+	}
+	if qi.cherr != nil {
+		if err := l.f.Sync(); err != nil {
+			return err
+		}
+	}
+	l.pending[l.gen]++
+	qi.wal = l.gen
+	return nil
+}
+
+// committed retires logged items the writer has committed, counted by
+// segment, and starts a new segment for later writes.
+func (l *writeAheadLog) committed(counts map[uint64]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for gen, n := range counts {
+		l.pending[gen] -= n
+	}
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+		l.gen++
+	}
+	for gen, n := range l.pending {
+		if n <= 0 && gen < l.gen {
+			os.Remove(walSegment(l.dbname, gen))
+			delete(l.pending, gen)
+		}
+	}
+}
+
+// close stops logging. Segments still pending stay for replay.
+func (l *writeAheadLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+	l.closed = true
+}
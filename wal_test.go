@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type walRecord struct {
+	op   dbOperation
+	k    string
+	data string
+}
+
+func writeWALRecords(t *testing.T, b []byte) string {
+	path := filepath.Join(t.TempDir(), "db.wal.1")
+	if err := ioutil.WriteFile(path, b, 0666); err != nil {
+		t.Fatalf("error writing segment: %v", err)
+	}
+	return path
+}
+
+func readWALRecords(t *testing.T, path string) ([]walRecord, error) {
+	rv := []walRecord{}
+	err := readWALSegment(path, func(op dbOperation, k string, data []byte) error {
+		rv = append(rv, walRecord{op, k, string(data)})
+		return nil
+	})
+	return rv, err
+}
+
+var testWALRecords = []walRecord{
+	{opStoreItem, "2021-11-07T09:30:00Z", `{"v":1}`},
+	{opDeleteItem, "2021-11-07T09:30:00Z", ""},
+	{opStoreItem, "2021-11-07T09:30:00Z#000001", ""},
+	{opStoreItem, "", `{"v":2}`},
+}
+
+func encodeTestWALRecords() []byte {
+	b := []byte{}
+	for _, r := range testWALRecords {
+		b = append(b, encodeWALRecord(dbqitem{op: r.op, k: r.k, data: []byte(r.data)})...)
+	}
+	return b
+}
+
+func TestWALRoundTrip(t *testing.T) {
+	got, err := readWALRecords(t, writeWALRecords(t, encodeTestWALRecords()))
+	if err != nil {
+		t.Fatalf("error reading segment: %v", err)
+	}
+	if !reflect.DeepEqual(got, testWALRecords) {
+		t.Errorf("read %v, want %v", got, testWALRecords)
+	}
+}
+
+// A record torn anywhere, as by a crash mid-write, ends the segment
+// without losing the records before it.
+func TestWALTornRecord(t *testing.T) {
+	b := encodeTestWALRecords()
+	last := len(encodeWALRecord(dbqitem{op: opStoreItem, data: []byte(`{"v":2}`)}))
+	for cut := len(b) - last; cut < len(b); cut++ {
+		got, err := readWALRecords(t, writeWALRecords(t, b[:cut]))
+		if err != nil {
+			t.Fatalf("error reading segment cut at %d: %v", cut, err)
+		}
+		want := testWALRecords[:len(testWALRecords)-1]
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("read %v from segment cut at %d, want %v", got, cut, want)
+		}
+	}
+}
+
+func TestWALZeroedTail(t *testing.T) {
+	b := append(encodeTestWALRecords(), make([]byte, 4096)...)
+	got, err := readWALRecords(t, writeWALRecords(t, b))
+	if err != nil {
+		t.Fatalf("error reading segment: %v", err)
+	}
+	if !reflect.DeepEqual(got, testWALRecords) {
+		t.Errorf("read %v, want %v", got, testWALRecords)
+	}
+}
+
+func TestWALBadChecksum(t *testing.T) {
+	b := encodeTestWALRecords()
+	first := len(encodeWALRecord(dbqitem{op: opStoreItem, k: testWALRecords[0].k,
+		data: []byte(testWALRecords[0].data)}))
+	b[first+8] ^= 0xff
+	got, err := readWALRecords(t, writeWALRecords(t, b))
+	if err != nil {
+		t.Fatalf("error reading segment: %v", err)
+	}
+	if !reflect.DeepEqual(got, testWALRecords[:1]) {
+		t.Errorf("read %v, want %v", got, testWALRecords[:1])
+	}
+}
+
+func TestWALBadKeyLength(t *testing.T) {
+	payload := []byte{byte(opStoreItem)}
+	payload = append(payload, make([]byte, binary.MaxVarintLen64)...)
+	n := binary.PutUvarint(payload[1:], 100)
+	payload = append(payload[:1+n], "short"...)
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+	b = append(b, payload...)
+
+	if _, err := readWALRecords(t, writeWALRecords(t, b)); err != errBadWALRecord {
+		t.Errorf("read a record with a bad key length with %v, want %v", err, errBadWALRecord)
+	}
+}